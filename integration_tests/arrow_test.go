@@ -0,0 +1,176 @@
+package main_test
+
+// arrow encoded grafana data frames used as test fixtures by the lua unit tests (src/unit_test.lua).
+// the frames are encoded with the apache arrow ipc writers like the grafana plugin sdk (data.Frame.MarshalArrow),
+// grafana stores the frame name, refId and meta (json) in the schema custom metadata.
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apache/arrow/go/v15/arrow"
+	"github.com/apache/arrow/go/v15/arrow/array"
+	"github.com/apache/arrow/go/v15/arrow/ipc"
+	"github.com/apache/arrow/go/v15/arrow/memory"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	arrowFixturesDirectory = "testdata/arrow"
+	arrowStreamContentType = "application/vnd.apache.arrow.stream"
+)
+
+var arrowFixtures = []struct {
+	fileName string
+	refId    string
+	meta     map[string]any
+}{
+	{
+		fileName: "frame_without_notices.arrows",
+		refId:    "A",
+		meta: map[string]any{
+			"executedQueryString": "up",
+		},
+	},
+	{
+		fileName: "frame_with_warning_notice.arrows",
+		refId:    "A",
+		meta: map[string]any{
+			"notices": []map[string]string{
+				{"severity": "warning", "text": "some series were dropped"},
+			},
+		},
+	},
+	{
+		fileName: "frame_with_error_notice.arrows",
+		refId:    "B",
+		meta: map[string]any{
+			"notices": []map[string]string{
+				{"severity": "error", "text": "query timed out"},
+			},
+		},
+	},
+}
+
+// newArrowFrame returns the arrow encoded data frame with a time and a value field, like a prometheus frame
+func newArrowFrame(refId string, meta map[string]any) ([]byte, error) {
+	metaBytes, err := json.Marshal(meta)
+	if err != nil {
+		return nil, fmt.Errorf("[newArrowFrame] json marshal frame meta failed: %w", err)
+	}
+	metadata := arrow.NewMetadata([]string{"name", "refId", "meta"}, []string{"", refId, string(metaBytes)})
+	schema := arrow.NewSchema([]arrow.Field{
+		{Name: "Time", Type: &arrow.TimestampType{Unit: arrow.Nanosecond}},
+		{Name: "Value", Type: arrow.PrimitiveTypes.Float64, Nullable: true},
+	}, &metadata)
+
+	builder := array.NewRecordBuilder(memory.DefaultAllocator, schema)
+	defer builder.Release()
+	builder.Field(0).(*array.TimestampBuilder).AppendValues([]arrow.Timestamp{1700000000000000000, 1700000015000000000}, nil)
+	builder.Field(1).(*array.Float64Builder).AppendValues([]float64{1, 0}, nil)
+	record := builder.NewRecord()
+	defer record.Release()
+
+	var buf bytes.Buffer
+	writer := ipc.NewWriter(&buf, ipc.WithSchema(schema))
+	if err := writer.Write(record); err != nil {
+		return nil, fmt.Errorf("[newArrowFrame] arrow record write failed: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("[newArrowFrame] arrow writer close failed: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// readArrowFrameMetadata reads the schema metadata with the apache arrow reader
+func readArrowFrameMetadata(payload []byte) (map[string]string, error) {
+	reader, err := ipc.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("[readArrowFrameMetadata] arrow reader failed: %w", err)
+	}
+	defer reader.Release()
+	schema := reader.Schema()
+	metadata := map[string]string{}
+	for i, key := range schema.Metadata().Keys() {
+		metadata[key] = schema.Metadata().Values()[i]
+	}
+	return metadata, nil
+}
+
+// TestArrowFixtures checks the committed arrow fixtures match the generated payloads.
+// set GENERATE_ARROW_FIXTURES=true to regenerate them.
+func TestArrowFixtures(t *testing.T) {
+	generate := os.Getenv("GENERATE_ARROW_FIXTURES") == "true"
+	for _, fixture := range arrowFixtures {
+		payload, err := newArrowFrame(fixture.refId, fixture.meta)
+		if !assert.NoError(t, err, fixture.fileName) {
+			return
+		}
+		metadata, err := readArrowFrameMetadata(payload)
+		if !assert.NoError(t, err, fixture.fileName) {
+			return
+		}
+		if !assert.Equal(t, fixture.refId, metadata["refId"], fixture.fileName) {
+			return
+		}
+		fixturePath := filepath.Join(arrowFixturesDirectory, fixture.fileName)
+		if generate {
+			if !assert.NoError(t, os.MkdirAll(arrowFixturesDirectory, 0755)) {
+				return
+			}
+			if !assert.NoError(t, os.WriteFile(fixturePath, payload, 0644), fixture.fileName) {
+				return
+			}
+			continue
+		}
+		expectedPayload, err := os.ReadFile(fixturePath)
+		if !assert.NoError(t, err, fixture.fileName) {
+			assert.Fail(t, "unable to read arrow fixture, run the test with GENERATE_ARROW_FIXTURES=true")
+			return
+		}
+		if !assert.Equal(t, expectedPayload, payload, fixture.fileName) {
+			assert.Fail(t, "arrow fixture outdated, run the test with GENERATE_ARROW_FIXTURES=true")
+			return
+		}
+	}
+}
+
+// arrow and json encoded responses should not share the cache entry
+func TestArrowAcceptHeaderCacheKey(t *testing.T) {
+	promReqBody := newPrometheusRequestBody(time.Now(), 30*time.Minute)
+	basicAuth := &grafanaBasicAuth{
+		User:     c.grafanaUser,
+		Password: c.grafanaPassword,
+	}
+
+	response, err := c.sendPrometheusQueryRequest(c.grafanaCacheUrl, promReqBody, basicAuth, nil)
+	if !assert.NoError(t, err, "TestArrowAcceptHeaderCacheKey") {
+		assert.Fail(t, "prometheus query request failed", err)
+		return
+	}
+	jsonCacheKey := response.Header.Get("X-Cache-Key")
+
+	response, err = c.sendPrometheusQueryRequestWithHeaders(c.grafanaCacheUrl, promReqBody, basicAuth, nil, http.Header{
+		"Accept": []string{arrowStreamContentType},
+	})
+	if !assert.NoError(t, err, "TestArrowAcceptHeaderCacheKey") {
+		assert.Fail(t, "prometheus query request failed", err)
+		return
+	}
+	arrowCacheKey := response.Header.Get("X-Cache-Key")
+
+	if !assert.NotEqual(t, jsonCacheKey, arrowCacheKey) {
+		assert.Fail(t, "arrow and json requests got the same cache key")
+		return
+	}
+	if !assert.True(t, strings.HasSuffix(arrowCacheKey, ";format=arrow"), arrowCacheKey) {
+		assert.Fail(t, "arrow cache key without format property")
+		return
+	}
+}
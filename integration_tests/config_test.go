@@ -3,6 +3,9 @@ package main_test
 // this file only contains config
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -24,12 +27,16 @@ const (
 	invalidateCacheDisabledScenario                = "invalidate_cache_disabled"
 	invalidateCacheEnabledForLocalhostScenario     = "invalidate_cache_enabled_for_localhost"
 	invalidateCacheEnabledForDockerNetworkScenario = "invalidate_cache_enabled_for_docker_network"
+	adminAuthEnabledScenario                       = "admin_auth_enabled"
+	tracingEnabledScenario                         = "tracing_enabled"
 )
 
 var SUPPORTED_SCENARIOS = []string{
 	invalidateCacheDisabledScenario,
 	invalidateCacheEnabledForLocalhostScenario,
 	invalidateCacheEnabledForDockerNetworkScenario,
+	adminAuthEnabledScenario,
+	tracingEnabledScenario,
 }
 
 var (
@@ -50,6 +57,7 @@ type config struct {
 	minUses                  int
 	invalidateCacheEnabled   bool
 	invalidateCacheAllowCidr string
+	adminAuthSecret          string
 	testScenario             string
 }
 
@@ -114,9 +122,10 @@ func getConfig() config {
 	}
 
 	var invalidateCacheAllowCidr = ""
+	adminAuthSecret := os.Getenv("ADMIN_AUTH_SECRET")
 	if invalidateCacheEnabled {
 		invalidateCacheAllowCidr = os.Getenv("CACHE_INVALIDATE_ENDPOINT_ALLOW_CIDR")
-		if len(invalidateCacheAllowCidr) == 0 {
+		if len(invalidateCacheAllowCidr) == 0 && len(adminAuthSecret) == 0 {
 			log.Fatal("CACHE_INVALIDATE_ENDPOINT_ENABLED not set")
 		}
 	}
@@ -129,6 +138,7 @@ func getConfig() config {
 		minUses:                  int(minUses),
 		invalidateCacheEnabled:   invalidateCacheEnabled,
 		invalidateCacheAllowCidr: invalidateCacheAllowCidr,
+		adminAuthSecret:          adminAuthSecret,
 		testScenario:             testScenario,
 	}
 }
@@ -189,6 +199,17 @@ func (config config) sendPrometheusQueryRequest(
 	requestBody prometheusRequestBody,
 	basicAuth *grafanaBasicAuth,
 	cookieJar *http.CookieJar,
+) (r *http.Response, err error) {
+	return config.sendPrometheusQueryRequestWithHeaders(baseUrl, requestBody, basicAuth, cookieJar, nil)
+}
+
+// sendPrometheusQueryRequestWithHeaders is same as sendPrometheusQueryRequest but also adds the input headers in the request
+func (config config) sendPrometheusQueryRequestWithHeaders(
+	baseUrl url.URL,
+	requestBody prometheusRequestBody,
+	basicAuth *grafanaBasicAuth,
+	cookieJar *http.CookieJar,
+	headers http.Header,
 ) (r *http.Response, err error) {
 	requestUrl, err := url.JoinPath(baseUrl.String(), "/api/ds/query")
 	if err != nil {
@@ -216,6 +237,11 @@ func (config config) sendPrometheusQueryRequest(
 	if basicAuth != nil {
 		req.SetBasicAuth(basicAuth.User, basicAuth.Password)
 	}
+	for key, values := range headers {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
 	req.Header.Set("Content-Type", "application/json")
 
 	client := &http.Client{}
@@ -263,9 +289,62 @@ func (config config) sendInvalidateCacheRequest(baseUrl url.URL) (r *http.Respon
 	if err != nil {
 		return nil, fmt.Errorf("unable to create post request: %w", err)
 	}
+	if len(config.adminAuthSecret) != 0 {
+		req.Header.Set("Authorization", "Bearer "+config.adminAuthSecret)
+	}
 	return client.Do(req)
 }
 
+// sendCacheEntriesRequest sends request to the /cache/entries admin endpoint, cacheKey is ignored if empty
+func (config config) sendCacheEntriesRequest(baseUrl url.URL, method string, cacheKey string) (r *http.Response, err error) {
+	requestUrl, err := url.JoinPath(baseUrl.String(), "/cache/entries")
+	if err != nil {
+		return nil, fmt.Errorf("unable to join url path: %w", err)
+	}
+	req, err := http.NewRequest(method, requestUrl, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create %s request: %w", method, err)
+	}
+	if len(cacheKey) != 0 {
+		queryParams := make(url.Values)
+		queryParams.Add("key", cacheKey)
+		req.URL.RawQuery = queryParams.Encode()
+	}
+	if len(config.adminAuthSecret) != 0 {
+		req.Header.Set("Authorization", "Bearer "+config.adminAuthSecret)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+func (config config) sendCacheWebhookRequest(baseUrl url.URL, payload any) (r *http.Response, err error) {
+	requestUrl, err := url.JoinPath(baseUrl.String(), "/cache/webhook")
+	if err != nil {
+		return nil, fmt.Errorf("unable to join url path: %w", err)
+	}
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal webhook payload: %w", err)
+	}
+	req, err := http.NewRequest("POST", requestUrl, bytes.NewReader(payloadBytes))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create post request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(config.adminAuthSecret) != 0 {
+		req.Header.Set("Authorization", "Bearer "+config.adminAuthSecret)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// signAdminRequest adds the HMAC signature headers expected by the admin endpoints (see src/admin_auth.lua)
+func signAdminRequest(req *http.Request, secret string, body []byte, now time.Time) {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(fmt.Sprintf("%s\n%s\n%s\n%s", req.Method, req.URL.RequestURI(), timestamp, body)))
+	req.Header.Set("X-Cache-Admin-Timestamp", timestamp)
+	req.Header.Set("X-Cache-Admin-Signature", hex.EncodeToString(mac.Sum(nil)))
+}
+
 // copied from - https://stackoverflow.com/questions/22892120/how-to-generate-a-random-string-of-a-fixed-length-in-go/22892986#22892986
 var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
 
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
+	"strconv"
 	"testing"
 	"time"
 
@@ -195,10 +196,213 @@ func TestQueryLabels(t *testing.T) {
 	}
 }
 
+func TestCacheMetadataInjection(t *testing.T) {
+	basicAuth := &grafanaBasicAuth{
+		User:     c.grafanaUser,
+		Password: c.grafanaPassword,
+	}
+	promReqBody := newPrometheusRequestBody(time.Now(), 30*time.Minute)
+	promReqBody.Queries[0].Expr = "# datasource=prometheus; inspector=true;\n" + promReqBody.Queries[0].Expr
+
+	var response *http.Response
+	var err error
+	for i := 0; i <= c.minUses; i++ {
+		response, err = c.sendPrometheusQueryRequest(c.grafanaCacheUrl, promReqBody, basicAuth, nil)
+		if !assert.NoError(t, err, "TestCacheMetadataInjection") {
+			assert.Fail(t, "prometheus query request failed", err)
+			return
+		}
+	}
+	if !assert.Equal(t, "HIT", response.Header.Get("X-Cache-Status"), "TestCacheMetadataInjection") ||
+		!assert.Equal(t, "prometheus-inspector", response.Header.Get("X-Cache-Config-ID"), "TestCacheMetadataInjection") {
+		assert.Fail(t, "did not get cache hit after min uses")
+		return
+	}
+
+	var queryResponse struct {
+		Results map[string]struct {
+			Frames []struct {
+				Schema struct {
+					Meta struct {
+						Notices []struct {
+							Severity string `json:"severity"`
+							Text     string `json:"text"`
+						} `json:"notices"`
+						Custom struct {
+							GrafanaQueryCache struct {
+								Status        string `json:"status"`
+								Key           string `json:"key"`
+								CacheConfigId string `json:"cache_config_id"`
+							} `json:"grafanaQueryCache"`
+						} `json:"custom"`
+					} `json:"meta"`
+				} `json:"schema"`
+			} `json:"frames"`
+		} `json:"results"`
+	}
+	if !assert.NoError(t, json.NewDecoder(response.Body).Decode(&queryResponse), "TestCacheMetadataInjection") {
+		assert.Fail(t, "invalid query response")
+		return
+	}
+	if !assert.NotEmpty(t, queryResponse.Results, "TestCacheMetadataInjection") {
+		return
+	}
+	for refId, result := range queryResponse.Results {
+		if !assert.NotEmpty(t, result.Frames, refId) {
+			continue
+		}
+		meta := result.Frames[0].Schema.Meta
+		assert.Equal(t, "HIT", meta.Custom.GrafanaQueryCache.Status, refId)
+		assert.Equal(t, response.Header.Get("X-Cache-Key"), meta.Custom.GrafanaQueryCache.Key, refId)
+		assert.Equal(t, "prometheus-inspector", meta.Custom.GrafanaQueryCache.CacheConfigId, refId)
+		if assert.NotEmpty(t, meta.Notices, refId) {
+			assert.Equal(t, "info", meta.Notices[len(meta.Notices)-1].Severity, refId)
+			assert.Contains(t, meta.Notices[len(meta.Notices)-1].Text, "served from cache", refId)
+		}
+	}
+}
+
+// CACHE_EXPIRE_TIME of the integration test containers
+const cacheExpireTime = 60 * time.Minute
+
+func TestFreshnessHeaders(t *testing.T) {
+	basicAuth := &grafanaBasicAuth{
+		User:     c.grafanaUser,
+		Password: c.grafanaPassword,
+	}
+	promReqBody := newPrometheusRequestBody(time.Now(), 20*time.Minute)
+
+	for i := 0; i <= c.minUses; i++ {
+		response, err := c.sendPrometheusQueryRequest(c.grafanaCacheUrl, promReqBody, basicAuth, nil)
+		if !assert.NoError(t, err, "TestFreshnessHeaders") {
+			assert.Fail(t, "prometheus query request failed", err)
+			return
+		}
+		cacheStatus := response.Header.Get("X-Cache-Status")
+		if i < c.minUses-1 {
+			// not stored until MIN_REQUEST_COUNT is reached
+			assert.Equal(t, "private, no-store", response.Header.Get("Cache-Control"), "request %d", i)
+			assert.Empty(t, response.Header.Get("Age"), "request %d", i)
+			continue
+		}
+		age, err := strconv.Atoi(response.Header.Get("Age"))
+		if !assert.NoError(t, err, "invalid Age header, cache status %s", cacheStatus) {
+			return
+		}
+		if cacheStatus != "HIT" {
+			assert.Equal(t, 0, age, "Age of the response fetched from grafana")
+		}
+		cacheDate, err := http.ParseTime(response.Header.Get("X-Cache-Date"))
+		if assert.NoError(t, err, "invalid X-Cache-Date header") {
+			assert.WithinDuration(t, time.Now().Add(-time.Duration(age)*time.Second), cacheDate, 5*time.Second)
+		}
+		var maxAge int
+		_, err = fmt.Sscanf(response.Header.Get("Cache-Control"), "private, max-age=%d", &maxAge)
+		if assert.NoError(t, err, "invalid Cache-Control header %s", response.Header.Get("Cache-Control")) {
+			assert.Equal(t, int(cacheExpireTime.Seconds()), age+maxAge, "max-age should be the remaining ttl")
+		}
+	}
+}
+
+func TestCacheBypass(t *testing.T) {
+	tests := []struct {
+		name                 string
+		headers              http.Header
+		expectedCacheStatus  string
+		expectedBypassReason string
+	}{
+		{
+			name:                 "no-bypass",
+			headers:              nil,
+			expectedCacheStatus:  "HIT",
+			expectedBypassReason: "",
+		},
+		{
+			name:                 "grafana-nocache-header",
+			headers:              http.Header{"X-Grafana-NoCache": []string{"1"}},
+			expectedCacheStatus:  "BYPASS",
+			expectedBypassReason: "header:X-Grafana-NoCache",
+		},
+		{
+			name:                 "grafana-cache-skip-header",
+			headers:              http.Header{"X-Cache-Skip": []string{"true"}},
+			expectedCacheStatus:  "BYPASS",
+			expectedBypassReason: "header:X-Cache-Skip",
+		},
+		{
+			name:                 "falsy-header-value",
+			headers:              http.Header{"X-Cache-Skip": []string{"false"}},
+			expectedCacheStatus:  "HIT",
+			expectedBypassReason: "",
+		},
+	}
+	// create cache
+	promReqBody := newPrometheusRequestBody(time.Now(), 30*time.Minute)
+	if !HitMinUses(t, promReqBody) {
+		return
+	}
+	for _, test := range tests {
+		response, err := c.sendPrometheusQueryRequestWithHeaders(c.grafanaCacheUrl, promReqBody, &grafanaBasicAuth{
+			User:     c.grafanaUser,
+			Password: c.grafanaPassword,
+		}, nil, test.headers)
+		if !assert.NoError(t, err, test.name) {
+			assert.Fail(t, "prometheus query request failed", err)
+			return
+		}
+		if !assert.Equal(t, http.StatusOK, response.StatusCode, test.name) {
+			assert.Fail(t, fmt.Sprintf("prometheus request return %d status code", response.StatusCode), err)
+			return
+		}
+		if !assert.Equal(t, test.expectedCacheStatus, response.Header.Get("X-Cache-Status"), test.name) {
+			assert.Fail(t, "unexpected cache status")
+			return
+		}
+		if !assert.Equal(t, test.expectedBypassReason, response.Header.Get("X-Cache-Bypass-Reason"), test.name) {
+			assert.Fail(t, "unexpected cache bypass reason")
+			return
+		}
+	}
+
+	// bypassed request should still refresh the cache
+	response, err := c.sendPrometheusQueryRequest(c.grafanaCacheUrl, promReqBody, &grafanaBasicAuth{
+		User:     c.grafanaUser,
+		Password: c.grafanaPassword,
+	}, nil)
+	if !assert.NoError(t, err, "TestCacheBypass") {
+		assert.Fail(t, "prometheus query request failed", err)
+		return
+	}
+	if !assert.Equal(t, "HIT", response.Header.Get("X-Cache-Status"), "TestCacheBypass") {
+		assert.Fail(t, "did not get cache hit after bypass")
+		return
+	}
+}
+
+func TestQueryErrorNotCached(t *testing.T) {
+	promReqBody := newPrometheusRequestBody(time.Now(), 30*time.Minute)
+	// invalid promql, grafana returns the parse error in results[refId].error
+	promReqBody.Queries[0].Expr = "sum(" + promReqBody.Queries[0].Expr
+	for i := 0; i <= c.minUses; i++ {
+		response, err := c.sendPrometheusQueryRequest(c.grafanaCacheUrl, promReqBody, &grafanaBasicAuth{
+			User:     c.grafanaUser,
+			Password: c.grafanaPassword,
+		}, nil)
+		if !assert.NoError(t, err, "TestQueryErrorNotCached") {
+			assert.Fail(t, "prometheus query request failed", err)
+			return
+		}
+		if !assert.NotEqual(t, "HIT", response.Header.Get("X-Cache-Status"), "TestQueryErrorNotCached") {
+			assert.Fail(t, "response with query error served from cache")
+			return
+		}
+	}
+}
+
 // scenario based tests
 func TestInvalidateCacheEndpointAllowCidr(t *testing.T) {
 	switch c.testScenario {
-	case invalidateCacheDisabledScenario:
+	case invalidateCacheDisabledScenario, tracingEnabledScenario:
 		{
 			t.Log("TestInvalidateCacheEndpoint disabled")
 			response, err := c.sendInvalidateCacheRequest(c.grafanaCacheUrl)
@@ -264,6 +468,9 @@ func TestInvalidateCacheEndpointAllowCidr(t *testing.T) {
 			}
 			return
 		}
+	case adminAuthEnabledScenario:
+		// covered by TestAdminAuth
+		return
 	default:
 		assert.Fail(t, "[TestInvalidateCacheEndpointAllowCidr]: invalid scenario")
 		return
@@ -273,11 +480,11 @@ func TestInvalidateCacheEndpointAllowCidr(t *testing.T) {
 func TestInvalidateCacheEndpoint(t *testing.T) {
 	var cacheProxyUrl url.URL
 	switch c.testScenario {
-	case invalidateCacheDisabledScenario:
+	case invalidateCacheDisabledScenario, tracingEnabledScenario:
 		return
 	case invalidateCacheEnabledForLocalhostScenario:
 		cacheProxyUrl = c.localGrafanaCacheUrl
-	case invalidateCacheEnabledForDockerNetworkScenario:
+	case invalidateCacheEnabledForDockerNetworkScenario, adminAuthEnabledScenario:
 		cacheProxyUrl = c.grafanaCacheUrl
 	default:
 		assert.Fail(t, "invalid scenario")
@@ -364,3 +571,274 @@ func TestInvalidateCacheEndpoint(t *testing.T) {
 		return
 	}
 }
+
+func TestCacheEntriesEndpoint(t *testing.T) {
+	var cacheProxyUrl url.URL
+	switch c.testScenario {
+	case invalidateCacheDisabledScenario, tracingEnabledScenario:
+		return
+	case invalidateCacheEnabledForLocalhostScenario:
+		cacheProxyUrl = c.localGrafanaCacheUrl
+	case invalidateCacheEnabledForDockerNetworkScenario, adminAuthEnabledScenario:
+		cacheProxyUrl = c.grafanaCacheUrl
+	default:
+		assert.Fail(t, "invalid scenario")
+		return
+	}
+	basicAuth := &grafanaBasicAuth{
+		User:     c.grafanaUser,
+		Password: c.grafanaPassword,
+	}
+
+	// store the response and get one cache hit
+	promReqBody := newPrometheusRequestBody(time.Now(), 30*time.Minute)
+	var cacheKey string
+	for i := 0; i <= c.minUses; i++ {
+		response, err := c.sendPrometheusQueryRequest(cacheProxyUrl, promReqBody, basicAuth, nil)
+		if !assert.NoError(t, err, "TestCacheEntriesEndpoint") {
+			assert.Fail(t, "prometheus query request failed", err)
+			return
+		}
+		cacheKey = response.Header.Get("X-Cache-Key")
+	}
+	if !assert.NotEqual(t, "", cacheKey, "TestCacheEntriesEndpoint") {
+		assert.Fail(t, "empty cache key in response")
+		return
+	}
+
+	// list
+	response, err := c.sendCacheEntriesRequest(cacheProxyUrl, "GET", "")
+	if !assert.NoError(t, err) || !assert.Equal(t, http.StatusOK, response.StatusCode) {
+		assert.Fail(t, "list cache entries request failed")
+		return
+	}
+	var list struct {
+		Entries []struct {
+			Key string `json:"key"`
+		} `json:"entries"`
+	}
+	if !assert.NoError(t, json.NewDecoder(response.Body).Decode(&list)) {
+		assert.Fail(t, "invalid list cache entries response")
+		return
+	}
+	found := false
+	for _, entry := range list.Entries {
+		found = found || entry.Key == cacheKey
+	}
+	if !assert.True(t, found, "cache key not listed") {
+		return
+	}
+
+	// inspect
+	response, err = c.sendCacheEntriesRequest(cacheProxyUrl, "GET", cacheKey)
+	if !assert.NoError(t, err) || !assert.Equal(t, http.StatusOK, response.StatusCode) {
+		assert.Fail(t, "get cache entry request failed")
+		return
+	}
+	var entry struct {
+		Key            string   `json:"key"`
+		Hits           int      `json:"hits"`
+		Size           int      `json:"size"`
+		StoredAt       int64    `json:"stored_at"`
+		DatasourceUIDs []string `json:"datasource_uids"`
+	}
+	if !assert.NoError(t, json.NewDecoder(response.Body).Decode(&entry)) {
+		assert.Fail(t, "invalid get cache entry response")
+		return
+	}
+	assert.Equal(t, cacheKey, entry.Key)
+	assert.Equal(t, 1, entry.Hits)
+	assert.Greater(t, entry.Size, 0)
+	assert.NotZero(t, entry.StoredAt)
+	assert.Equal(t, []string{"prometheus"}, entry.DatasourceUIDs)
+
+	// delete
+	response, err = c.sendCacheEntriesRequest(cacheProxyUrl, "DELETE", cacheKey)
+	if !assert.NoError(t, err) || !assert.Equal(t, http.StatusOK, response.StatusCode) {
+		assert.Fail(t, "delete cache entry request failed")
+		return
+	}
+	response, err = c.sendPrometheusQueryRequest(cacheProxyUrl, promReqBody, basicAuth, nil)
+	if !assert.NoError(t, err, "TestCacheEntriesEndpoint") {
+		assert.Fail(t, "prometheus query request failed", err)
+		return
+	}
+	if !assert.NotEqual(t, "HIT", response.Header.Get("X-Cache-Status")) {
+		assert.Fail(t, "deleted cache entry served from cache")
+		return
+	}
+}
+
+func TestCacheWebhook(t *testing.T) {
+	var cacheProxyUrl url.URL
+	switch c.testScenario {
+	case invalidateCacheDisabledScenario, tracingEnabledScenario:
+		return
+	case invalidateCacheEnabledForLocalhostScenario:
+		cacheProxyUrl = c.localGrafanaCacheUrl
+	case invalidateCacheEnabledForDockerNetworkScenario, adminAuthEnabledScenario:
+		cacheProxyUrl = c.grafanaCacheUrl
+	default:
+		assert.Fail(t, "invalid scenario")
+		return
+	}
+	basicAuth := &grafanaBasicAuth{
+		User:     c.grafanaUser,
+		Password: c.grafanaPassword,
+	}
+	dashboardUid := "webhook-" + randString(8)
+	headers := http.Header{}
+	headers.Set("X-Dashboard-Uid", dashboardUid)
+
+	tests := []struct {
+		name    string
+		payload any
+	}{
+		{
+			name: "simple payload",
+			payload: map[string]any{
+				"dashboard_uids": []string{dashboardUid},
+			},
+		},
+		{
+			name: "grafana alert payload",
+			payload: map[string]any{
+				"status": "firing",
+				"alerts": []map[string]any{
+					{
+						"status":      "firing",
+						"labels":      map[string]string{"alertname": "datasource changed"},
+						"annotations": map[string]string{"__dashboardUid__": dashboardUid},
+					},
+				},
+			},
+		},
+	}
+	for _, test := range tests {
+		// store the response
+		promReqBody := newPrometheusRequestBody(time.Now(), 30*time.Minute)
+		var response *http.Response
+		var err error
+		for i := 0; i <= c.minUses; i++ {
+			response, err = c.sendPrometheusQueryRequestWithHeaders(cacheProxyUrl, promReqBody, basicAuth, nil, headers)
+			if !assert.NoError(t, err, test.name) {
+				assert.Fail(t, "prometheus query request failed", err)
+				return
+			}
+		}
+		if !assert.Equal(t, "HIT", response.Header.Get("X-Cache-Status"), test.name) {
+			assert.Fail(t, "response not cached")
+			return
+		}
+		cacheKey := response.Header.Get("X-Cache-Key")
+
+		response, err = c.sendCacheWebhookRequest(cacheProxyUrl, test.payload)
+		if !assert.NoError(t, err, test.name) || !assert.Equal(t, http.StatusOK, response.StatusCode, test.name) {
+			assert.Fail(t, "webhook request failed")
+			return
+		}
+		var webhookResponse struct {
+			Generations map[string]int64 `json:"generations"`
+			Removed     []string         `json:"removed"`
+			Failed      []string         `json:"failed"`
+		}
+		if !assert.NoError(t, json.NewDecoder(response.Body).Decode(&webhookResponse), test.name) {
+			assert.Fail(t, "invalid webhook response")
+			return
+		}
+		assert.Contains(t, webhookResponse.Generations, "dashboard:"+dashboardUid, test.name)
+		assert.Contains(t, webhookResponse.Removed, cacheKey, test.name)
+		assert.Empty(t, webhookResponse.Failed, test.name)
+
+		response, err = c.sendPrometheusQueryRequestWithHeaders(cacheProxyUrl, promReqBody, basicAuth, nil, headers)
+		if !assert.NoError(t, err, test.name) {
+			assert.Fail(t, "prometheus query request failed", err)
+			return
+		}
+		if !assert.NotEqual(t, "HIT", response.Header.Get("X-Cache-Status"), test.name) {
+			assert.Fail(t, "invalidated cache entry served from cache")
+			return
+		}
+		// the generation of the dashboard is part of the cache key
+		assert.NotEqual(t, cacheKey, response.Header.Get("X-Cache-Key"), test.name)
+	}
+
+	// payload without uids
+	response, err := c.sendCacheWebhookRequest(cacheProxyUrl, map[string]any{"alerts": []any{}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+}
+
+func TestAdminAuth(t *testing.T) {
+	if c.testScenario != adminAuthEnabledScenario {
+		return
+	}
+	requestUrl, err := url.JoinPath(c.grafanaCacheUrl.String(), "/cache/invalidate")
+	if !assert.NoError(t, err) {
+		return
+	}
+	tests := []struct {
+		name               string
+		prepare            func(req *http.Request)
+		expectedStatusCode int
+	}{
+		{
+			name:               "without credentials",
+			prepare:            func(req *http.Request) {},
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name: "invalid bearer token",
+			prepare: func(req *http.Request) {
+				req.Header.Set("Authorization", "Bearer invalid-"+c.adminAuthSecret)
+			},
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name: "bearer token",
+			prepare: func(req *http.Request) {
+				req.Header.Set("Authorization", "Bearer "+c.adminAuthSecret)
+			},
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name: "signed request",
+			prepare: func(req *http.Request) {
+				signAdminRequest(req, c.adminAuthSecret, nil, time.Now())
+			},
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name: "signed with invalid secret",
+			prepare: func(req *http.Request) {
+				signAdminRequest(req, "invalid-"+c.adminAuthSecret, nil, time.Now())
+			},
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name: "expired signature",
+			prepare: func(req *http.Request) {
+				signAdminRequest(req, c.adminAuthSecret, nil, time.Now().Add(-10*time.Minute))
+			},
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("POST", requestUrl, nil)
+		if !assert.NoError(t, err, test.name) {
+			return
+		}
+		test.prepare(req)
+		response, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err, test.name) {
+			assert.Fail(t, "invalidate request failed", err)
+			return
+		}
+		if !assert.Equal(t, test.expectedStatusCode, response.StatusCode, test.name) {
+			assert.Fail(t, "[TestAdminAuth]: got invalid status code")
+			return
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TRACING_OTLP_ENDPOINT of the tracing_enabled scenario points to this address of the integration-test container
+const stubCollectorAddress = ":4318"
+
+type otlpSpan struct {
+	TraceId      string `json:"traceId"`
+	SpanId       string `json:"spanId"`
+	ParentSpanId string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Kind         int    `json:"kind"`
+}
+
+type otlpExportTraceServiceRequest struct {
+	ResourceSpans []struct {
+		ScopeSpans []struct {
+			Spans []otlpSpan `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+// stubCollector is a minimal OTLP/HTTP traces receiver, only the json encoding used by src/tracing.lua is supported
+type stubCollector struct {
+	server *http.Server
+	mutex  sync.Mutex
+	spans  []otlpSpan
+}
+
+func startStubCollector(address string) (*stubCollector, error) {
+	collector := &stubCollector{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/traces", collector.handleTraces)
+	collector.server = &http.Server{Addr: address, Handler: mux}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		if err := collector.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			panic(err)
+		}
+	}()
+	return collector, nil
+}
+
+func (collector *stubCollector) handleTraces(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	var request otlpExportTraceServiceRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+	for _, resourceSpans := range request.ResourceSpans {
+		for _, scopeSpans := range resourceSpans.ScopeSpans {
+			collector.spans = append(collector.spans, scopeSpans.Spans...)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte("{}"))
+}
+
+// waitForSpans returns the spans of the trace once the span with the name is received
+func (collector *stubCollector) waitForSpans(traceId string, name string, timeout time.Duration) []otlpSpan {
+	deadline := time.Now().Add(timeout)
+	for {
+		var spans []otlpSpan
+		found := false
+		collector.mutex.Lock()
+		for _, span := range collector.spans {
+			if span.TraceId == traceId {
+				spans = append(spans, span)
+				found = found || span.Name == name
+			}
+		}
+		collector.mutex.Unlock()
+		if found || time.Now().After(deadline) {
+			return spans
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+func (collector *stubCollector) close() {
+	collector.server.Close()
+}
+
+func TestTracing(t *testing.T) {
+	if c.testScenario != tracingEnabledScenario {
+		return
+	}
+	collector, err := startStubCollector(stubCollectorAddress)
+	if !assert.NoError(t, err, "TestTracing") {
+		assert.Fail(t, "unable to start the stub collector")
+		return
+	}
+	defer collector.close()
+
+	basicAuth := &grafanaBasicAuth{
+		User:     c.grafanaUser,
+		Password: c.grafanaPassword,
+	}
+	traceId := "4bf92f3577b34da6a3ce929d0e0e4736"
+	parentSpanId := "00f067aa0ba902b7"
+	headers := http.Header{}
+	headers.Set("traceparent", "00-"+traceId+"-"+parentSpanId+"-01")
+
+	response, err := c.sendPrometheusQueryRequestWithHeaders(
+		c.grafanaCacheUrl,
+		newPrometheusRequestBody(time.Now(), 30*time.Minute),
+		basicAuth,
+		nil,
+		headers,
+	)
+	if !assert.NoError(t, err, "TestTracing") || !assert.Equal(t, http.StatusOK, response.StatusCode) {
+		assert.Fail(t, "prometheus query request failed", err)
+		return
+	}
+
+	spans := collector.waitForSpans(traceId, "POST /api/ds/query", 10*time.Second)
+	spansByName := make(map[string]otlpSpan)
+	for _, span := range spans {
+		spansByName[span.Name] = span
+	}
+	root, found := spansByName["POST /api/ds/query"]
+	if !assert.True(t, found, "root span not exported") {
+		return
+	}
+	assert.Equal(t, parentSpanId, root.ParentSpanId, "root span should continue the incoming trace")
+	for _, name := range []string{
+		"generate cache key",
+		"check datasource access",
+		"cache lookup",
+		"grafana POST /api/ds/query",
+	} {
+		span, found := spansByName[name]
+		if !assert.True(t, found, "span %s not exported", name) {
+			continue
+		}
+		assert.Equal(t, root.SpanId, span.ParentSpanId, "parent of span %s", name)
+	}
+	datasourceSpan, found := spansByName["GET /api/datasources/uid"]
+	if assert.True(t, found, "datasource access check span not exported") {
+		assert.Equal(t, spansByName["check datasource access"].SpanId, datasourceSpan.ParentSpanId)
+	}
+}
@@ -26,10 +26,171 @@ function init_variables() {
     export CACHE_RULES_FILE_PATH=${CACHE_RULES_FILE_PATH:-"/etc/grafana-query-cache/cache_rules.yaml"}
     export CACHE_INVALIDATE_ENDPOINT_ENABLED=${CACHE_INVALIDATE_ENDPOINT_ENABLED:-"false"}
     export CACHE_INVALIDATE_ENDPOINT_ALLOW_CIDR=${CACHE_INVALIDATE_ENDPOINT_ALLOW_CIDR:-""}
+    export CACHE_BYPASS_HEADERS=${CACHE_BYPASS_HEADERS:-"X-Grafana-NoCache,X-Cache-Skip"}
+    export CACHE_BYPASS_QUERY_PARAMS=${CACHE_BYPASS_QUERY_PARAMS:-"nocache"}
+    export MAX_CACHEABLE_RESPONSE_SIZE=${MAX_CACHEABLE_RESPONSE_SIZE:-"10m"}
+    export CACHE_RESPONSES_WITH_ERRORS=${CACHE_RESPONSES_WITH_ERRORS:-"false"}
+    export CACHE_COMPRESSION=${CACHE_COMPRESSION:-"off"}
+    export CACHE_COMPRESSION_LEVEL=${CACHE_COMPRESSION_LEVEL:-"5"}
+    export CACHE_COMPRESSION_LISTEN=${CACHE_COMPRESSION_LISTEN:-"127.0.0.1:8090"}
+    export METRICS_ENDPOINT_ENABLED=${METRICS_ENDPOINT_ENABLED:-"false"}
+    export METRICS_ENDPOINT_ALLOW_CIDR=${METRICS_ENDPOINT_ALLOW_CIDR:-"127.0.0.1/32"}
+    export CACHE_INDEX_SIZE=${CACHE_INDEX_SIZE:-"10m"}
+    export ADMIN_AUTH_SECRET=${ADMIN_AUTH_SECRET:-""}
+    export ADMIN_AUTH_SECRET_FILE=${ADMIN_AUTH_SECRET_FILE:-""}
+    export ADMIN_AUTH_REQUIRE_GRAFANA_ADMIN=${ADMIN_AUTH_REQUIRE_GRAFANA_ADMIN:-"false"}
+    export CACHE_KEY_PREFIX_FILE=${CACHE_KEY_PREFIX_FILE-"/var/lib/nginx/grafana-query-cache/cache_key_prefix"}
+    export CACHE_KEY_PREFIX_SYNC=${CACHE_KEY_PREFIX_SYNC:-"off"}
+    export CACHE_KEY_PREFIX_REDIS_URL=${CACHE_KEY_PREFIX_REDIS_URL:-""}
+    export CACHE_KEY_PREFIX_REDIS_KEY=${CACHE_KEY_PREFIX_REDIS_KEY:-"grafana_query_cache:cache_key_prefix"}
+    export CACHE_KEY_PREFIX_SYNC_INTERVAL=${CACHE_KEY_PREFIX_SYNC_INTERVAL:-"5s"}
+    export NGINX_WORKER_USER=${NGINX_WORKER_USER:-"nobody"}
+    export ACCESS_LOG_FORMAT=${ACCESS_LOG_FORMAT:-"text"}
+    export TRACING_ENABLED=${TRACING_ENABLED:-"false"}
+    export TRACING_OTLP_ENDPOINT=${TRACING_OTLP_ENDPOINT:-"http://localhost:4318/v1/traces"}
+    export TRACING_SERVICE_NAME=${TRACING_SERVICE_NAME:-"grafana-query-cache"}
+    export TRACING_SAMPLE_RATIO=${TRACING_SAMPLE_RATIO:-"1"}
+    export TRACING_EXPORT_INTERVAL=${TRACING_EXPORT_INTERVAL:-"5s"}
+    export STRIP_QUERY_LABELS=${STRIP_QUERY_LABELS:-"false"}
+    export GRAFANA_UPSTREAMS_FILE=${GRAFANA_UPSTREAMS_FILE:-""}
+    export GRAFANA_HEALTH_CHECK_ENABLED=${GRAFANA_HEALTH_CHECK_ENABLED:-"false"}
+    export GRAFANA_HEALTH_CHECK_PATH=${GRAFANA_HEALTH_CHECK_PATH:-"/api/health"}
+    export GRAFANA_HEALTH_CHECK_INTERVAL=${GRAFANA_HEALTH_CHECK_INTERVAL:-"5s"}
+    export GRAFANA_CA_FILE=${GRAFANA_CA_FILE:-""}
+    export GRAFANA_CLIENT_CERT=${GRAFANA_CLIENT_CERT:-""}
+    export GRAFANA_CLIENT_KEY=${GRAFANA_CLIENT_KEY:-""}
+    export GRAFANA_TLS_VERIFY=${GRAFANA_TLS_VERIFY:-"true"}
+    export SYSTEM_CA_FILE=${SYSTEM_CA_FILE:-"/etc/ssl/certs/ca-certificates.crt"}
+    # host of the first GRAFANA_HOST, without the brackets of an ipv6 address
+    first_grafana_host=${GRAFANA_HOST%%,*}
+    if [[ "$first_grafana_host" =~ ^\[([^]]+)\] ]]; then
+        first_grafana_host=${BASH_REMATCH[1]}
+    else
+        first_grafana_host=${first_grafana_host%%:*}
+    fi
+    export GRAFANA_TLS_SERVER_NAME=${GRAFANA_TLS_SERVER_NAME:-"$first_grafana_host"}
+
+    export ENV_VARIABLES_LIST='$GRAFANA_HOST, $GRAFANA_SCHEME, $MAX_CACHE_SIZE, $KEY_ZONE_SIZE, $MAX_INACTIVE_TIME, $CACHE_EXPIRE_TIME, $CACHE_DIRECTORY, $CACHE_VERSION, $SERVER_NAME, $LISTEN, $SSL, $SSL_CERTIFICATE, $SSL_CERTIFICATE_KEY, $SSL_PROTOCOLS, $SSL_CIPHERS, $SSL_CONFIG, $CLIENT_MAX_BODY_SIZE, $DEBUG_IP_CADR, $MIN_REQUEST_COUNT, $CACHE_RULES_FILE_PATH, $CACHE_BYPASS_HEADERS, $CACHE_BYPASS_QUERY_PARAMS, $MAX_CACHEABLE_RESPONSE_SIZE, $CACHE_RESPONSES_WITH_ERRORS, $CACHE_COMPRESSION, $CACHE_COMPRESSION_LEVEL, $CACHE_COMPRESSION_LISTEN, $METRICS_ENDPOINT_ENABLED, $METRICS_ENDPOINT_ALLOW_CIDR, $CACHE_INDEX_SIZE, $ADMIN_AUTH_SECRET_FILE, $ADMIN_AUTH_REQUIRE_GRAFANA_ADMIN, $CACHE_KEY_PREFIX_FILE, $CACHE_KEY_PREFIX_SYNC, $CACHE_KEY_PREFIX_REDIS_URL, $CACHE_KEY_PREFIX_REDIS_KEY, $CACHE_KEY_PREFIX_SYNC_INTERVAL, $ACCESS_LOG_FORMAT, $TRACING_ENABLED, $TRACING_OTLP_ENDPOINT, $TRACING_SERVICE_NAME, $TRACING_SAMPLE_RATIO, $TRACING_EXPORT_INTERVAL, $STRIP_QUERY_LABELS, $GRAFANA_UPSTREAMS_FILE, $GRAFANA_HEALTH_CHECK_ENABLED, $GRAFANA_HEALTH_CHECK_PATH, $GRAFANA_HEALTH_CHECK_INTERVAL, $GRAFANA_CA_FILE, $GRAFANA_CLIENT_CERT, $GRAFANA_CLIENT_KEY, $GRAFANA_TLS_SERVER_NAME, $GRAFANA_TLS_VERIFY, $SYSTEM_CA_FILE'
+
+    if [[ ! "$GRAFANA_HOST" =~ ^[^,[:space:]]+(,[^,[:space:]]+)*$ ]]; then
+        echo "invalid GRAFANA_HOST \"$GRAFANA_HOST\", expected a comma separated list of host:port without spaces"
+        return 1
+    fi
+
+    if [[ ( "$GRAFANA_CLIENT_CERT" == "" && "$GRAFANA_CLIENT_KEY" != "" ) || ( "$GRAFANA_CLIENT_CERT" != "" && "$GRAFANA_CLIENT_KEY" == "" ) ]]; then
+        echo "GRAFANA_CLIENT_CERT and GRAFANA_CLIENT_KEY must be set together"
+        return 1
+    fi
+    for grafana_tls_file in "$GRAFANA_CA_FILE" "$GRAFANA_CLIENT_CERT" "$GRAFANA_CLIENT_KEY"; do
+        if [[ "$grafana_tls_file" != "" && ! -r "$grafana_tls_file" ]]; then
+            echo "unable to read \"$grafana_tls_file\""
+            return 1
+        fi
+    done
+
+    if [[ "$GRAFANA_TLS_VERIFY" != "true" && "$GRAFANA_TLS_VERIFY" != "false" ]]; then
+        echo "invalid GRAFANA_TLS_VERIFY \"$GRAFANA_TLS_VERIFY\", valid values are: true and false"
+        return 1
+    fi
+    init_trusted_certificates
+    exit_code=$?
+    if [ $exit_code -ne 0 ]; then
+        return $exit_code
+    fi
+
+    if [[ "$CACHE_COMPRESSION" != "off" && "$CACHE_COMPRESSION" != "gzip" ]]; then
+        echo "invalid CACHE_COMPRESSION \"$CACHE_COMPRESSION\", valid values are: off and gzip"
+        return 1
+    fi
+
+    if [[ "$ACCESS_LOG_FORMAT" != "text" && "$ACCESS_LOG_FORMAT" != "json" ]]; then
+        echo "invalid ACCESS_LOG_FORMAT \"$ACCESS_LOG_FORMAT\", valid values are: text and json"
+        return 1
+    fi
+
+    init_admin_auth_secret
+    exit_code=$?
+    if [ $exit_code -ne 0 ]; then
+        return $exit_code
+    fi
+    if [[ "$CACHE_INVALIDATE_ENDPOINT_ENABLED" == "true" && "$CACHE_INVALIDATE_ENDPOINT_ALLOW_CIDR" == "" && "$ADMIN_AUTH_SECRET_FILE" == "" && "$ADMIN_AUTH_REQUIRE_GRAFANA_ADMIN" != "true" ]]; then
+        echo "admin endpoints are not protected, set CACHE_INVALIDATE_ENDPOINT_ALLOW_CIDR, ADMIN_AUTH_SECRET(_FILE) or ADMIN_AUTH_REQUIRE_GRAFANA_ADMIN"
+        return 1
+    fi
+
+    if [[ "$GRAFANA_UPSTREAMS_FILE" != "" && ! -r "$GRAFANA_UPSTREAMS_FILE" ]]; then
+        echo "unable to read GRAFANA_UPSTREAMS_FILE \"$GRAFANA_UPSTREAMS_FILE\""
+        return 1
+    fi
 
-    export ENV_VARIABLES_LIST='$GRAFANA_HOST, $GRAFANA_SCHEME, $MAX_CACHE_SIZE, $KEY_ZONE_SIZE, $MAX_INACTIVE_TIME, $CACHE_EXPIRE_TIME, $CACHE_DIRECTORY, $CACHE_VERSION, $SERVER_NAME, $LISTEN, $SSL, $SSL_CERTIFICATE, $SSL_CERTIFICATE_KEY, $SSL_PROTOCOLS, $SSL_CIPHERS, $SSL_CONFIG, $CLIENT_MAX_BODY_SIZE, $DEBUG_IP_CADR, $MIN_REQUEST_COUNT, $CACHE_RULES_FILE_PATH'
+    if [[ "$CACHE_KEY_PREFIX_SYNC" != "off" && "$CACHE_KEY_PREFIX_SYNC" != "redis" ]]; then
+        echo "invalid CACHE_KEY_PREFIX_SYNC \"$CACHE_KEY_PREFIX_SYNC\", valid values are: off and redis"
+        return 1
+    fi
+    if [[ "$CACHE_KEY_PREFIX_SYNC" == "redis" && "$CACHE_KEY_PREFIX_REDIS_URL" == "" ]]; then
+        echo "CACHE_KEY_PREFIX_REDIS_URL is required when CACHE_KEY_PREFIX_SYNC is redis"
+        return 1
+    fi
 
     mkdir -p "${CACHE_DIRECTORY}"
+    init_cache_key_prefix_directory
+}
+
+# the cache key prefix file can not be stored in CACHE_DIRECTORY, the nginx cache loader deletes the unknown files.
+# the file is updated by the worker processes on invalidation
+function init_cache_key_prefix_directory() {
+    if [[ "$CACHE_KEY_PREFIX_FILE" == "" ]]; then
+        return 0
+    fi
+    cache_key_prefix_directory=$(dirname "$CACHE_KEY_PREFIX_FILE")
+    mkdir -p "$cache_key_prefix_directory"
+    if [ "$(id -u)" == "0" ]; then
+        chown "$NGINX_WORKER_USER" "$cache_key_prefix_directory" || echo "unable to change the owner of $cache_key_prefix_directory to $NGINX_WORKER_USER"
+    fi
+}
+
+# GRAFANA_TRUSTED_CA_FILE verifies the proxied requests to grafana, GRAFANA_CA_FILE or the system CAs.
+# LUA_SSL_TRUSTED_CERTIFICATE is the trust store of all the lua cosockets (access checks, health check, span exporter,
+# redis), the system CAs and GRAFANA_CA_FILE, so the other services with a public CA are still verified
+function init_trusted_certificates() {
+    if [[ "$GRAFANA_CA_FILE" == "" ]]; then
+        if [ ! -r "$SYSTEM_CA_FILE" ]; then
+            echo "unable to read SYSTEM_CA_FILE \"$SYSTEM_CA_FILE\""
+            return 1
+        fi
+        export GRAFANA_TRUSTED_CA_FILE="$SYSTEM_CA_FILE"
+        export LUA_SSL_TRUSTED_CERTIFICATE="$SYSTEM_CA_FILE"
+        return 0
+    fi
+    export GRAFANA_TRUSTED_CA_FILE="$GRAFANA_CA_FILE"
+    export LUA_SSL_TRUSTED_CERTIFICATE=${LUA_SSL_GENERATED_TRUSTED_CERTIFICATE:-"/etc/grafana-query-cache/lua_trusted_certificates.pem"}
+    cat "$GRAFANA_CA_FILE" > "$LUA_SSL_TRUSTED_CERTIFICATE"
+    if [ $? -ne 0 ]; then
+        echo "unable to write the trusted certificates to \"$LUA_SSL_TRUSTED_CERTIFICATE\""
+        return 1
+    fi
+    if [ -r "$SYSTEM_CA_FILE" ]; then
+        printf "\n" >> "$LUA_SSL_TRUSTED_CERTIFICATE" && cat "$SYSTEM_CA_FILE" >> "$LUA_SSL_TRUSTED_CERTIFICATE"
+    fi
+}
+
+# the admin secret is passed to nginx as a file, so it is not written in the generated nginx config
+function init_admin_auth_secret() {
+    if [[ "$ADMIN_AUTH_SECRET_FILE" != "" ]]; then
+        if [ ! -r "$ADMIN_AUTH_SECRET_FILE" ]; then
+            echo "unable to read ADMIN_AUTH_SECRET_FILE \"$ADMIN_AUTH_SECRET_FILE\""
+            return 1
+        fi
+        return 0
+    fi
+    if [[ "$ADMIN_AUTH_SECRET" != "" ]]; then
+        export ADMIN_AUTH_SECRET_FILE=${ADMIN_AUTH_GENERATED_SECRET_FILE:-"/etc/grafana-query-cache/admin_auth_secret"}
+        (umask 077 && printf "%s" "$ADMIN_AUTH_SECRET" > "$ADMIN_AUTH_SECRET_FILE")
+        if [ $? -ne 0 ]; then
+            echo "unable to write the admin secret to \"$ADMIN_AUTH_SECRET_FILE\""
+            return 1
+        fi
+    fi
 }
 
 function genrate_nginx_conf() {
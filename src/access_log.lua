@@ -0,0 +1,72 @@
+-- json access log of the query requests (ACCESS_LOG_FORMAT=json).
+-- the log line is generated in log_by_lua and written by the access_log directive using the $json_access_log variable,
+-- lua log handler runs before the nginx access log handler.
+local json = require "cjson";
+
+--- returns the sum of the nginx upstream time variables, e.g. "0.012, 0.003" for retried requests
+--- @param value string|nil
+--- @return number|nil seconds returns `nil` if the request was not sent to the upstream
+function parse_upstream_time(value)
+    if type(value) ~= "string" then
+        return nil
+    end
+    local total = nil
+    for time in value:gmatch("[%d%.]+") do
+        total = (total or 0) + (tonumber(time) or 0)
+    end
+    return total
+end
+
+--- @param value string|nil
+--- @return string|nil returns `nil` for empty values so they are omitted in the log line
+local function non_empty(value)
+    if value == nil or value == "" or value == "-" then
+        return nil
+    end
+    return value
+end
+
+--- returns the access log entry of the request
+--- @param vars table nginx variables (ngx.var)
+--- @param ctx table request context (ngx.ctx), set by set_cache_key.lua and response_filter.lua
+--- @return table
+function get_access_log_entry(vars, ctx)
+    return {
+        time = vars.time_iso8601,
+        request_id = vars.request_id,
+        remote_addr = vars.remote_addr,
+        method = vars.request_method,
+        uri = vars.request_uri,
+        status = tonumber(vars.status),
+        bytes_sent = tonumber(vars.body_bytes_sent),
+        request_time = tonumber(vars.request_time),
+        upstream_time = parse_upstream_time(vars.upstream_response_time),
+        access_check_time = ctx.access_check_time,
+        cache_status = non_empty(vars.upstream_cache_status),
+        cache_key = non_empty(vars.cache_key),
+        cache_config_id = non_empty(vars.cache_config_id),
+        cache_access_denied = vars.cache_access_denied == "1",
+        cache_bypass_reason = non_empty(vars.cache_bypass_reason),
+        cache_not_stored_reason = ctx.not_stored_reason,
+        cache_key_error = ctx.cache_key_error,
+        labels = ctx.labels,
+        datasource_uids = ctx.datasource_uids,
+        dashboard_uid = non_empty(vars.http_x_dashboard_uid),
+    }
+end
+
+--- log handler of the query location, sets $json_access_log
+local function log()
+    local ok, line = pcall(json.encode, get_access_log_entry(ngx.var, ngx.ctx))
+    if not ok then
+        ngx.log(ngx.STDERR, "failed to encode the access log: ", line)
+        return
+    end
+    ngx.var.json_access_log = line
+end
+
+return {
+    parse_upstream_time = parse_upstream_time,
+    get_access_log_entry = get_access_log_entry,
+    log = log
+}
@@ -0,0 +1,227 @@
+-- authentication of the admin endpoints (/cache/invalidate, /cache/entries).
+-- requests are authenticated using the admin secret either as bearer token or as HMAC-SHA1 signature key,
+-- optionally the user must also be a Grafana server admin.
+local json = require "cjson";
+local bit = require "bit"
+local resty_sha256 = require "resty.sha256"
+local grafana_client = require "grafana_client"
+local utils = require "utils"
+
+ADMIN_SIGNATURE_HEADER = "X-Cache-Admin-Signature"
+ADMIN_TIMESTAMP_HEADER = "X-Cache-Admin-Timestamp"
+-- signed requests older/newer than this are rejected to limit replays
+ADMIN_SIGNATURE_MAX_CLOCK_SKEW_SECONDS = 300
+
+AUTH_METHOD_BEARER = "bearer"
+AUTH_METHOD_HMAC = "hmac"
+
+-- loaded once in init_by_lua, inherited by the workers
+local admin_secret = nil
+
+--- loads the admin secret from the file, empty file path disables the secret based authentication
+--- @param file_path string
+function load_secret(file_path)
+    if type(file_path) ~= "string" or string.len(file_path) == 0 then
+        admin_secret = nil
+        return
+    end
+    local file = io.open(file_path, "rb")
+    if file == nil then
+        error("unable to open admin auth secret file " .. file_path)
+    end
+    local secret = file:read("*all")
+    file:close()
+    secret = secret:gsub("%s+$", "")
+    if string.len(secret) == 0 then
+        error("empty admin auth secret in " .. file_path)
+    end
+    admin_secret = secret
+end
+
+--- @param value string
+--- @return string binary digest
+local function sha256(value)
+    local sha = resty_sha256:new()
+    sha:update(value)
+    return sha:final()
+end
+
+--- compares the strings in constant time, the sha256 digests are compared
+--- so the comparison time doesn't depend on the length of the strings either
+--- @param a string
+--- @param b string
+--- @return boolean
+function secure_compare(a, b)
+    if type(a) ~= "string" or type(b) ~= "string" then
+        return false
+    end
+    local digest_a, digest_b = sha256(a), sha256(b)
+    local difference = 0
+    for i = 1, string.len(digest_a) do
+        difference = bit.bor(difference, bit.bxor(digest_a:byte(i), digest_b:byte(i)))
+    end
+    return difference == 0
+end
+
+--- @param authorization_header string|nil
+--- @return string|nil token
+function get_bearer_token(authorization_header)
+    if type(authorization_header) ~= "string" then
+        return nil
+    end
+    local token = authorization_header:match("^%s*[Bb]earer%s+(%S+)%s*$")
+    return token
+end
+
+--- @param value string
+--- @return string
+function to_hex(value)
+    return (value:gsub(".", function(c) return string.format("%02x", c:byte()) end))
+end
+
+--- returns the signed payload, request_uri includes the query params (e.g. ?key= of /cache/entries)
+--- @param method string
+--- @param request_uri string
+--- @param timestamp string
+--- @param body string|nil
+--- @return string
+function get_signing_payload(method, request_uri, timestamp, body)
+    return string.format("%s\n%s\n%s\n%s", method, request_uri, timestamp, body or "")
+end
+
+---@class AdminRequest
+---@field method string
+---@field request_uri string
+---@field headers table
+---@field body string|nil
+
+--- authenticates the request using the bearer token or the HMAC signature
+--- @param secret string
+--- @param request AdminRequest
+--- @param now number
+--- @param hmac_sha1 function (key, message) -> binary digest, ngx.hmac_sha1
+--- @return string|nil auth_method returns `nil` if the request is not authenticated
+--- @return string errorMessage
+function authenticate(secret, request, now, hmac_sha1)
+    local signature = request.headers[ADMIN_SIGNATURE_HEADER]
+    if signature ~= nil then
+        local timestamp = request.headers[ADMIN_TIMESTAMP_HEADER]
+        if type(signature) ~= "string" or type(timestamp) ~= "string" or tonumber(timestamp) == nil then
+            return nil, "invalid signature or timestamp header"
+        end
+        if math.abs(now - tonumber(timestamp)) > ADMIN_SIGNATURE_MAX_CLOCK_SKEW_SECONDS then
+            return nil, "signature timestamp outside the allowed clock skew"
+        end
+        local payload = get_signing_payload(request.method, request.request_uri, timestamp, request.body)
+        if not secure_compare(to_hex(hmac_sha1(secret, payload)), string.lower(signature)) then
+            return nil, "invalid signature"
+        end
+        return AUTH_METHOD_HMAC, ""
+    end
+
+    local token = get_bearer_token(request.headers["Authorization"])
+    if token == nil then
+        return nil, "missing bearer token or signature"
+    end
+    if not secure_compare(token, secret) then
+        return nil, "invalid bearer token"
+    end
+    return AUTH_METHOD_BEARER, ""
+end
+
+--- parses the grafana /api/user response
+--- @param status number
+--- @param body string
+--- @return string|nil login returns `nil` if the user is not a grafana server admin
+--- @return string errorMessage
+function get_grafana_admin_login(status, body)
+    if status ~= 200 then
+        return nil, string.format("grafana user request returned %s status code", tostring(status))
+    end
+    local ok, user = pcall(json.decode, body)
+    if not ok or type(user) ~= "table" then
+        return nil, "invalid grafana user response"
+    end
+    if user.isGrafanaAdmin ~= true then
+        return nil, "user is not a grafana admin"
+    end
+    return tostring(user.login), ""
+end
+
+--- checks the user is a grafana server admin, the request credentials (cookie/authorization) are forwarded to grafana
+--- @param cookie_header_value string
+--- @param authorization_header_value string
+--- @return string|nil login
+--- @return string errorMessage
+function check_grafana_admin(cookie_header_value, authorization_header_value)
+    local request_headers = {}
+    if string.len(cookie_header_value) ~= 0 then
+        request_headers["Cookie"] = cookie_header_value
+    end
+    if string.len(authorization_header_value) ~= 0 then
+        request_headers["Authorization"] = authorization_header_value
+    end
+    local res, err = grafana_client.get("/api/user", request_headers)
+    if res == nil then
+        return nil, "grafana user request failed: " .. tostring(err)
+    end
+    return get_grafana_admin_login(res.status, res.body)
+end
+
+--- access handler of the admin locations, the result is available in the
+--- $admin_auth_method and $admin_auth_user variables for the audit log
+local function access()
+    local headers = ngx.req.get_headers()
+    local require_grafana_admin = ngx.var.admin_auth_require_grafana_admin == "true"
+    if admin_secret == nil and not require_grafana_admin then
+        ngx.var.admin_auth_method = "cidr"
+        return
+    end
+
+    local authorization_header = headers["Authorization"] or ""
+    if admin_secret ~= nil then
+        local auth_method, errorMessage = authenticate(admin_secret, {
+            method = ngx.req.get_method(),
+            request_uri = ngx.var.request_uri,
+            headers = headers,
+            -- large bodies are buffered to a file
+            body = utils.get_body_data(),
+        }, ngx.time(), ngx.hmac_sha1)
+        if auth_method == nil then
+            ngx.log(ngx.INFO, "admin request not authenticated: ", errorMessage)
+            return ngx.exit(ngx.HTTP_UNAUTHORIZED)
+        end
+        ngx.var.admin_auth_method = auth_method
+        if auth_method == AUTH_METHOD_BEARER then
+            -- admin token is not a grafana credential
+            authorization_header = ""
+        end
+    end
+
+    if require_grafana_admin then
+        local login, errorMessage = check_grafana_admin(
+            headers["Cookie"] or "",
+            authorization_header
+        )
+        if login == nil then
+            ngx.log(ngx.INFO, "admin request denied: ", errorMessage)
+            return ngx.exit(ngx.HTTP_FORBIDDEN)
+        end
+        ngx.var.admin_auth_user = login
+        if admin_secret == nil then
+            ngx.var.admin_auth_method = "grafana"
+        end
+    end
+end
+
+return {
+    load_secret = load_secret,
+    secure_compare = secure_compare,
+    get_bearer_token = get_bearer_token,
+    to_hex = to_hex,
+    get_signing_payload = get_signing_payload,
+    authenticate = authenticate,
+    get_grafana_admin_login = get_grafana_admin_login,
+    check_grafana_admin = check_grafana_admin,
+    access = access
+}
@@ -0,0 +1,209 @@
+-- minimal reader for the apache arrow IPC format (stream and file), only the schema message is read.
+-- grafana stores the data frame name, refId and meta (json) in the schema custom metadata.
+-- https://arrow.apache.org/docs/format/Columnar.html#serialization-and-interprocess-communication-ipc
+local json = require "cjson";
+
+ARROW_FILE_MAGIC = "ARROW1"
+ARROW_CONTINUATION_MARKER = 0xFFFFFFFF
+ARROW_MESSAGE_HEADER_SCHEMA = 1
+ARROW_CONTENT_TYPE_PATTERN = "application/vnd%.apache%.arrow"
+
+-- flatbuffer field ids
+MESSAGE_FIELD_HEADER_TYPE = 1
+MESSAGE_FIELD_HEADER = 2
+SCHEMA_FIELD_CUSTOM_METADATA = 2
+KEY_VALUE_FIELD_KEY = 0
+KEY_VALUE_FIELD_VALUE = 1
+
+-- all the positions below are 0 based offsets in the flatbuffer
+
+--- @param data string
+--- @param pos number
+--- @return number
+local function read_u16(data, pos)
+    local b1, b2 = string.byte(data, pos + 1, pos + 2)
+    return b1 + b2 * 256
+end
+
+--- @param data string
+--- @param pos number
+--- @return number
+local function read_u32(data, pos)
+    local b1, b2, b3, b4 = string.byte(data, pos + 1, pos + 4)
+    return b1 + b2 * 256 + b3 * 65536 + b4 * 16777216
+end
+
+--- @param data string
+--- @param pos number
+--- @return number
+local function read_i32(data, pos)
+    local value = read_u32(data, pos)
+    if value >= 2147483648 then
+        value = value - 4294967296
+    end
+    return value
+end
+
+--- returns the position of the table field, `nil` if the field is not set
+--- @param data string
+--- @param table_pos number
+--- @param field_id number
+--- @return number|nil
+local function get_field_position(data, table_pos, field_id)
+    local vtable_pos = table_pos - read_i32(data, table_pos)
+    local vtable_size = read_u16(data, vtable_pos)
+    local vtable_entry = 4 + field_id * 2
+    if vtable_entry >= vtable_size then
+        return nil
+    end
+    local field_offset = read_u16(data, vtable_pos + vtable_entry)
+    if field_offset == 0 then
+        return nil
+    end
+    return table_pos + field_offset
+end
+
+--- follows the uoffset stored at pos
+--- @param data string
+--- @param pos number
+--- @return number
+local function read_reference(data, pos)
+    return pos + read_u32(data, pos)
+end
+
+--- @param data string
+--- @param pos number
+--- @return string
+local function read_string(data, pos)
+    local length = read_u32(data, pos)
+    return data:sub(pos + 5, pos + 4 + length)
+end
+
+--- returns the string field of the table, `nil` if the field is not set
+--- @param data string
+--- @param table_pos number
+--- @param field_id number
+--- @return string|nil
+local function read_string_field(data, table_pos, field_id)
+    local field_pos = get_field_position(data, table_pos, field_id)
+    if field_pos == nil then
+        return nil
+    end
+    return read_string(data, read_reference(data, field_pos))
+end
+
+--- is_arrow returns true if the response is arrow encoded, checks the content type and the magic bytes
+--- @param content_type string|nil
+--- @param body string
+--- @return boolean
+function is_arrow(content_type, body)
+    if type(content_type) == "string" and content_type:find(ARROW_CONTENT_TYPE_PATTERN) ~= nil then
+        return true
+    end
+    if type(body) ~= "string" or string.len(body) < 8 then
+        return false
+    end
+    return body:sub(1, 6) == ARROW_FILE_MAGIC or read_u32(body, 0) == ARROW_CONTINUATION_MARKER
+end
+
+--- @param data string
+--- @return table|nil metadata
+--- @return string errorMessage
+local function read_schema_metadata_unsafe(data)
+    local pos = 0
+    if data:sub(1, 6) == ARROW_FILE_MAGIC then
+        -- magic is padded to 8 bytes
+        pos = 8
+    end
+    local message_length = read_u32(data, pos)
+    if message_length == ARROW_CONTINUATION_MARKER then
+        pos = pos + 4
+        message_length = read_u32(data, pos)
+    end
+    pos = pos + 4
+    if message_length == 0 or pos + message_length > string.len(data) then
+        return nil, "invalid arrow message length"
+    end
+    local message = data:sub(pos + 1, pos + message_length)
+
+    local message_pos = read_u32(message, 0)
+    local header_type_pos = get_field_position(message, message_pos, MESSAGE_FIELD_HEADER_TYPE)
+    if header_type_pos == nil or string.byte(message, header_type_pos + 1) ~= ARROW_MESSAGE_HEADER_SCHEMA then
+        return nil, "first arrow message is not a schema"
+    end
+    local header_pos = get_field_position(message, message_pos, MESSAGE_FIELD_HEADER)
+    if header_pos == nil then
+        return nil, "arrow schema message without header"
+    end
+    local schema_pos = read_reference(message, header_pos)
+
+    local metadata = {}
+    local metadata_pos = get_field_position(message, schema_pos, SCHEMA_FIELD_CUSTOM_METADATA)
+    if metadata_pos == nil then
+        return metadata, ""
+    end
+    local vector_pos = read_reference(message, metadata_pos)
+    local vector_length = read_u32(message, vector_pos)
+    for index = 0, vector_length - 1 do
+        local element_pos = vector_pos + 4 + index * 4
+        local key_value_pos = read_reference(message, element_pos)
+        local key = read_string_field(message, key_value_pos, KEY_VALUE_FIELD_KEY)
+        if key ~= nil then
+            metadata[key] = read_string_field(message, key_value_pos, KEY_VALUE_FIELD_VALUE) or ""
+        end
+    end
+    return metadata, ""
+end
+
+--- read_schema_metadata returns the custom metadata of the arrow schema (first message of the stream/file)
+--- @param data string
+--- @return table|nil metadata
+--- @return string errorMessage
+function read_schema_metadata(data)
+    if type(data) ~= "string" or string.len(data) < 8 then
+        return nil, "arrow data too short"
+    end
+    local ok, metadata, errorMessage = pcall(read_schema_metadata_unsafe, data)
+    if not ok then
+        -- out of range reads end up here
+        return nil, "invalid arrow data: " .. tostring(metadata)
+    end
+    return metadata, errorMessage
+end
+
+--- get_frame_error returns the first error notice of the grafana data frame meta
+--- @param frame_meta table|nil
+--- @return string|nil errorMessage returns `nil` if there are no error notices
+function get_frame_error(frame_meta)
+    if type(frame_meta) ~= "table" or type(frame_meta.notices) ~= "table" then
+        return nil
+    end
+    for _, notice in pairs(frame_meta.notices) do
+        if type(notice) == "table" and notice.severity == "error" then
+            return tostring(notice.text)
+        end
+    end
+    return nil
+end
+
+--- get_arrow_frame_error returns the first error notice stored in the arrow encoded data frame
+--- @param data string
+--- @return string|nil errorMessage returns `nil` if there are no error notices or the data is not readable
+function get_arrow_frame_error(data)
+    local metadata = read_schema_metadata(data)
+    if metadata == nil or type(metadata.meta) ~= "string" then
+        return nil
+    end
+    local ok, frame_meta = pcall(json.decode, metadata.meta)
+    if not ok then
+        return nil
+    end
+    return get_frame_error(frame_meta)
+end
+
+return {
+    is_arrow = is_arrow,
+    read_schema_metadata = read_schema_metadata,
+    get_frame_error = get_frame_error,
+    get_arrow_frame_error = get_arrow_frame_error
+}
@@ -0,0 +1,49 @@
+local md5 = require "md5";
+
+--- returns the path of the nginx cache file for the cache key
+--- path depends on the proxy_cache_path levels, we use levels=1:2
+--- e.g. md5 = b7f54b2df7773722d382f4809d65029c, path = <cache_directory>/c/29/b7f54b2df7773722d382f4809d65029c
+--- @param cache_directory string
+--- @param cache_key string
+--- @return string
+function get_cache_file_path(cache_directory, cache_key)
+    local hash = md5.sumhexa(cache_key)
+    if cache_directory:sub(-1) == "/" then
+        cache_directory = cache_directory:sub(1, -2)
+    end
+    return string.format("%s/%s/%s/%s", cache_directory, hash:sub(-1), hash:sub(-3, -2), hash)
+end
+
+--- deletes the cached response for the cache key.
+--- nginx treats a missing cache file as a cache miss, so the in memory keys zone entry does not need any update.
+--- @param cache_directory string
+--- @param cache_key string
+--- @return boolean deleted
+--- @return string errorMessage
+function delete_cache_file(cache_directory, cache_key)
+    local file_path = get_cache_file_path(cache_directory, cache_key)
+    local success, err_msg = os.remove(file_path)
+    if success == nil then
+        return false, "unable to delete cache file, ERR: " .. tostring(err_msg)
+    end
+    return true, ""
+end
+
+--- checks if the response of the cache key is stored in the cache directory
+--- @param cache_directory string
+--- @param cache_key string
+--- @return boolean
+function cache_file_exists(cache_directory, cache_key)
+    local file = io.open(get_cache_file_path(cache_directory, cache_key), "rb")
+    if file == nil then
+        return false
+    end
+    file:close()
+    return true
+end
+
+return {
+    get_cache_file_path = get_cache_file_path,
+    delete_cache_file = delete_cache_file,
+    cache_file_exists = cache_file_exists
+}
@@ -0,0 +1,259 @@
+-- index of the cache keys, used by the cache admin endpoints.
+-- nginx doesn't expose the keys zone, so the metadata is recorded in the cache_index shared dict
+-- when the cache key is generated and updated once the response is sent.
+local json = require "cjson";
+local utils = require "utils"
+local cache_file = require "cache_file"
+
+INDEX_METADATA_PREFIX = "entry:"
+INDEX_HITS_PREFIX = "hits:"
+INDEX_REQUESTS_PREFIX = "requests:"
+
+-- statuses for which the response is fetched from grafana and written in the cache
+STORED_CACHE_STATUSES = {
+    MISS = true,
+    EXPIRED = true,
+    BYPASS = true,
+}
+
+---@class CacheIndexEntry
+---@field key string
+---@field cache_config_id string
+---@field datasource_uids table
+---@field dashboard_uids table|nil dashboards which sent the queries (X-Dashboard-Uid), the same queries can be shared by dashboards
+---@field created_at number
+---@field last_access number
+---@field stored_at number|nil
+---@field size number|nil
+
+--- @param index table shared dict
+--- @param cache_key string
+--- @return CacheIndexEntry|nil
+local function get_metadata(index, cache_key)
+    local value = index:get(INDEX_METADATA_PREFIX .. cache_key)
+    if value == nil then
+        return nil
+    end
+    local ok, entry = pcall(json.decode, value)
+    if not ok or type(entry) ~= "table" then
+        return nil
+    end
+    return entry
+end
+
+--- @param index table shared dict
+--- @param entry CacheIndexEntry
+--- @param ttl number|nil
+local function set_metadata(index, entry, ttl)
+    local success, err = index:set(INDEX_METADATA_PREFIX .. entry.key, json.encode(entry), ttl or 0)
+    if success ~= true then
+        ngx.log(ngx.STDERR, "failed to update cache index: ", err)
+    end
+end
+
+--- record_request adds/updates the cache key in the index, called after generating the cache key
+--- @param index table shared dict
+--- @param cache_key string
+--- @param cache_config_id string
+--- @param datasource_uids table
+--- @param dashboard_uid string|nil
+--- @param now number
+--- @param ttl number|nil entries expire with the cache entry (MAX_INACTIVE_TIME)
+function record_request(index, cache_key, cache_config_id, datasource_uids, dashboard_uid, now, ttl)
+    local entry = get_metadata(index, cache_key) or {
+        key = cache_key,
+        created_at = now,
+    }
+    entry.cache_config_id = cache_config_id
+    entry.datasource_uids = datasource_uids
+    if type(dashboard_uid) == "string" and string.len(dashboard_uid) ~= 0 then
+        entry.dashboard_uids = entry.dashboard_uids or {}
+        if not utils.table_contains(entry.dashboard_uids, dashboard_uid) then
+            table.insert(entry.dashboard_uids, dashboard_uid)
+        end
+    end
+    entry.last_access = now
+    set_metadata(index, entry, ttl)
+    index:incr(INDEX_REQUESTS_PREFIX .. cache_key, 1, 0, ttl)
+end
+
+--- record_response updates hit count, size and stored time of the cache key
+--- @param index table shared dict
+--- @param cache_key string
+--- @param cache_status string $upstream_cache_status
+--- @param size number|nil size of the stored response
+--- @param stored boolean false if the response was removed from the cache (see response_filter)
+--- @param now number
+--- @param ttl number|nil
+function record_response(index, cache_key, cache_status, size, stored, now, ttl)
+    local entry = get_metadata(index, cache_key)
+    if entry == nil then
+        return
+    end
+    if cache_status == "HIT" or cache_status == "STALE" or cache_status == "UPDATING" then
+        index:incr(INDEX_HITS_PREFIX .. cache_key, 1, 0, ttl)
+        return
+    end
+    if STORED_CACHE_STATUSES[cache_status] ~= true then
+        return
+    end
+    if stored then
+        entry.stored_at = now
+        entry.size = size
+    else
+        entry.stored_at = nil
+        entry.size = nil
+    end
+    set_metadata(index, entry, ttl)
+end
+
+--- returns the entry with the counters and age
+--- @param index table shared dict
+--- @param cache_key string
+--- @param now number
+--- @return table|nil
+function get_entry(index, cache_key, now)
+    local entry = get_metadata(index, cache_key)
+    if entry == nil then
+        return nil
+    end
+    entry.hits = index:get(INDEX_HITS_PREFIX .. cache_key) or 0
+    entry.requests = index:get(INDEX_REQUESTS_PREFIX .. cache_key) or 0
+    if entry.stored_at ~= nil then
+        entry.age_seconds = now - entry.stored_at
+    end
+    return entry
+end
+
+--- returns the time the response of the cache key was stored
+--- @param index table shared dict
+--- @param cache_key string
+--- @return number|nil stored_at returns `nil` if the response is not stored or the key is not indexed
+function get_stored_at(index, cache_key)
+    local entry = get_metadata(index, cache_key)
+    if entry == nil then
+        return nil
+    end
+    return entry.stored_at
+end
+
+--- returns all the indexed entries sorted by key
+--- @param index table shared dict
+--- @param now number
+--- @return table
+function list_entries(index, now)
+    local entries = {}
+    for _, index_key in pairs(index:get_keys(0)) do
+        if index_key:sub(1, #INDEX_METADATA_PREFIX) == INDEX_METADATA_PREFIX then
+            local entry = get_entry(index, index_key:sub(#INDEX_METADATA_PREFIX + 1), now)
+            if entry ~= nil then
+                table.insert(entries, entry)
+            end
+        end
+    end
+    table.sort(entries, function(a, b) return a.key < b.key end)
+    return entries
+end
+
+--- removes the cache key from the index
+--- @param index table shared dict
+--- @param cache_key string
+function delete_entry(index, cache_key)
+    index:delete(INDEX_METADATA_PREFIX .. cache_key)
+    index:delete(INDEX_HITS_PREFIX .. cache_key)
+    index:delete(INDEX_REQUESTS_PREFIX .. cache_key)
+end
+
+--- @return number|nil
+local function get_index_ttl()
+    return utils.parse_duration(ngx.var.max_inactive_time)
+end
+
+--- log handler of the cache location, runs after response_filter.log
+local function log()
+    local cache_key = ngx.var.cache_key
+    if cache_key == nil or string.len(cache_key) == 0 then
+        return
+    end
+    -- the response is not stored until proxy_cache_min_uses is reached
+    local stored = ngx.ctx.not_stored_reason == nil and STORED_CACHE_STATUSES[ngx.var.upstream_cache_status] == true
+        and cache_file.cache_file_exists(ngx.var.cache_directory, cache_key)
+    record_response(
+        ngx.shared.cache_index,
+        cache_key,
+        ngx.var.upstream_cache_status,
+        tonumber(ngx.var.upstream_response_length),
+        stored,
+        ngx.time(),
+        get_index_ttl()
+    )
+end
+
+--- @param status number
+--- @param body table|string
+local function send_json(status, body)
+    ngx.status = status
+    ngx.header["Content-Type"] = "application/json"
+    ngx.say(json.encode(body))
+    ngx.exit(status)
+end
+
+--- content handler of /cache/entries
+--- GET /cache/entries - list all the entries
+--- GET /cache/entries?key=<cache key> - metadata of the entry
+--- DELETE /cache/entries?key=<cache key> - removes the entry from the cache
+local function serve_admin()
+    local index = ngx.shared.cache_index
+    local cache_key = ngx.req.get_uri_args()["key"]
+    local method = ngx.req.get_method()
+    local now = ngx.time()
+
+    if cache_key == nil then
+        if method ~= "GET" then
+            return send_json(ngx.HTTP_NOT_ALLOWED, { error = "method not allowed" })
+        end
+        local entries = list_entries(index, now)
+        if #entries == 0 then
+            entries = json.empty_array
+        end
+        return send_json(ngx.HTTP_OK, { entries = entries })
+    end
+    if type(cache_key) ~= "string" or string.len(cache_key) == 0 then
+        return send_json(ngx.HTTP_BAD_REQUEST, { error = "invalid key" })
+    end
+
+    local entry = get_entry(index, cache_key, now)
+    if method == "GET" then
+        if entry == nil then
+            return send_json(ngx.HTTP_NOT_FOUND, { error = "key not found" })
+        end
+        return send_json(ngx.HTTP_OK, entry)
+    end
+    if method == "DELETE" then
+        local deleted, errorMessage = cache_file.delete_cache_file(ngx.var.cache_directory, cache_key)
+        if not deleted and cache_file.cache_file_exists(ngx.var.cache_directory, cache_key) then
+            -- the entry is kept in the index so the deletion can be retried
+            ngx.log(ngx.STDERR, "cache file not removed for ", cache_key, " ", errorMessage)
+            return send_json(ngx.HTTP_INTERNAL_SERVER_ERROR, { key = cache_key, deleted = false, error = errorMessage })
+        end
+        delete_entry(index, cache_key)
+        -- the cache file doesn't exist if the response was not stored or was already evicted by nginx
+        if entry == nil and not deleted then
+            return send_json(ngx.HTTP_NOT_FOUND, { error = "key not found" })
+        end
+        return send_json(ngx.HTTP_OK, { key = cache_key, deleted = true })
+    end
+    return send_json(ngx.HTTP_NOT_ALLOWED, { error = "method not allowed" })
+end
+
+return {
+    record_request = record_request,
+    record_response = record_response,
+    get_entry = get_entry,
+    get_stored_at = get_stored_at,
+    list_entries = list_entries,
+    delete_entry = delete_entry,
+    log = log,
+    send_json = send_json,
+    serve_admin = serve_admin
+}
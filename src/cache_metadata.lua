@@ -0,0 +1,268 @@
+-- cache metadata of the query responses.
+-- the Age, X-Cache-Date and Cache-Control headers are set from the time the response was stored,
+-- and if the inject_cache_metadata flag of the cache config is set the metadata (status, age, key, cache config id)
+-- is injected in the data frames, so the grafana query inspector shows if the panel was served from the cache.
+-- the cached response is not modified.
+local utils = require "utils"
+local cache_index = require "cache_index"
+
+-- key of the metadata in schema.meta.custom
+CACHE_METADATA_CUSTOM_KEY = "grafanaQueryCache"
+
+-- statuses for which the response is served from the cache
+CACHED_STATUSES = {
+    HIT = true,
+    STALE = true,
+    UPDATING = true,
+}
+
+---@class CacheMetadata
+---@field status string $upstream_cache_status
+---@field age number|nil seconds since the response was stored, `nil` if the cached response is not in the cache index
+---@field key string
+---@field cache_config_id string
+
+--- @param seconds number
+--- @return string e.g. 45s, 4m, 2h, 3d
+function format_age(seconds)
+    seconds = math.max(0, math.floor(seconds))
+    if seconds < 60 then
+        return seconds .. "s"
+    end
+    if seconds < 60 * 60 then
+        return math.floor(seconds / 60) .. "m"
+    end
+    if seconds < 24 * 60 * 60 then
+        return math.floor(seconds / (60 * 60)) .. "h"
+    end
+    return math.floor(seconds / (24 * 60 * 60)) .. "d"
+end
+
+--- @param metadata CacheMetadata
+--- @return string
+function get_cache_metadata_notice(metadata)
+    if CACHED_STATUSES[metadata.status] then
+        local age = "age unknown"
+        if metadata.age ~= nil then
+            age = format_age(metadata.age) .. " old"
+        end
+        return string.format("served from cache, %s (cache config %s)", age, metadata.cache_config_id)
+    end
+    return string.format("not served from cache (%s)", metadata.status)
+end
+
+--- adds the metadata to schema.meta.custom of every frame and an info notice to the first frame of every query result
+--- @param parsed_response table
+--- @param metadata CacheMetadata
+--- @return boolean injected
+function inject_cache_metadata(parsed_response, metadata)
+    if type(parsed_response) ~= "table" or type(parsed_response.results) ~= "table" then
+        return false
+    end
+    local injected = false
+    for _, result in pairs(parsed_response.results) do
+        if type(result) == "table" and type(result.frames) == "table" then
+            for index, frame in ipairs(result.frames) do
+                if type(frame) == "table" and type(frame.schema) == "table" then
+                    if type(frame.schema.meta) ~= "table" then
+                        frame.schema.meta = {}
+                    end
+                    local meta = frame.schema.meta
+                    if type(meta.custom) ~= "table" then
+                        meta.custom = {}
+                    end
+                    meta.custom[CACHE_METADATA_CUSTOM_KEY] = metadata
+                    if index == 1 then
+                        if type(meta.notices) ~= "table" then
+                            meta.notices = setmetatable({}, utils.roundtrip_json.array_mt)
+                        end
+                        table.insert(meta.notices, { severity = "info", text = get_cache_metadata_notice(metadata) })
+                    end
+                    injected = true
+                end
+            end
+        end
+    end
+    return injected
+end
+
+--- @param body string json encoded query response
+--- @param metadata CacheMetadata
+--- @return string|nil body returns `nil` if the body could not be modified
+function inject_cache_metadata_into_body(body, metadata)
+    local ok, parsed_response = pcall(utils.roundtrip_json.decode, body)
+    if not ok or not inject_cache_metadata(parsed_response, metadata) then
+        return nil
+    end
+    local encoded_ok, encoded_body = pcall(utils.roundtrip_json.encode, parsed_response)
+    if not encoded_ok then
+        return nil
+    end
+    return encoded_body
+end
+
+--- returns the Age, X-Cache-Date and Cache-Control headers of the response.
+--- max-age is the remaining time before the cached response expires, so the browser doesn't keep the response
+--- longer than the proxy
+--- @param cacheable boolean false if the response is not stored in the cache (see is_response_stored)
+--- @param stored_at number|nil
+--- @param now number
+--- @param expire_seconds number|nil CACHE_EXPIRE_TIME
+--- @return table<string, string>
+function get_freshness_headers(cacheable, stored_at, now, expire_seconds)
+    if not cacheable then
+        return { ["Cache-Control"] = "private, no-store" }
+    end
+    if stored_at == nil or expire_seconds == nil then
+        -- age unknown, the browser has to revalidate
+        return { ["Cache-Control"] = "private, max-age=0" }
+    end
+    local age = math.max(0, now - stored_at)
+    return {
+        ["Age"] = tostring(age),
+        -- same format as ngx.http_time, which is not available in the unit tests
+        ["X-Cache-Date"] = os.date("!%a, %d %b %Y %H:%M:%S GMT", stored_at),
+        ["Cache-Control"] = string.format("private, max-age=%d", math.max(0, math.floor(expire_seconds - age))),
+    }
+end
+
+--- returns true if the response is (or is being) written in the cache.
+--- the headers are sent before the body is inspected, so a query error is only known from the reason recorded
+--- for the previous response of the cache key (see response_filter.header_filter)
+--- @param status number
+--- @param cache_status string $upstream_cache_status
+--- @param access_denied boolean
+--- @param not_stored_reason string|nil
+--- @param requests number|nil requests of the cache key (cache index), `nil` if the key is not indexed
+--- @param min_uses number|nil proxy_cache_min_uses
+--- @return boolean
+function is_response_stored(status, cache_status, access_denied, not_stored_reason, requests, min_uses)
+    if status ~= 200 or access_denied then
+        return false
+    end
+    if CACHED_STATUSES[cache_status] then
+        return true
+    end
+    if STORED_CACHE_STATUSES[cache_status] ~= true then
+        return false
+    end
+    if not_stored_reason ~= nil and string.len(not_stored_reason) ~= 0 then
+        return false
+    end
+    -- nginx stores the response once the cache key is requested min_uses times
+    return requests ~= nil and min_uses ~= nil and requests >= min_uses
+end
+
+--- returns if the response is stored and the time it was stored, responses fetched from grafana are stored now
+--- @param cache_status string $upstream_cache_status
+--- @param now number
+--- @return boolean stored
+--- @return number|nil stored_at returns `nil` if the response is not stored or the cached response is not in the cache index
+local function get_response_stored_at(cache_status, now)
+    local index = ngx.shared.cache_index
+    local entry = cache_index.get_entry(index, ngx.var.cache_key, now)
+    local stored = is_response_stored(
+        ngx.status,
+        cache_status,
+        ngx.var.cache_access_denied == "1",
+        ngx.ctx.not_stored_reason or ngx.var.cache_not_stored_reason,
+        entry and entry.requests,
+        tonumber(ngx.var.cache_min_uses)
+    )
+    if not stored then
+        return false, nil
+    end
+    if CACHED_STATUSES[cache_status] then
+        return true, entry and entry.stored_at
+    end
+    return true, now
+end
+
+--- header filter of the query location, sets the freshness headers.
+--- the content length changes if the metadata is injected, so it is removed
+local function header_filter()
+    local cache_status = ngx.var.upstream_cache_status or ""
+    local now = ngx.time()
+    local stored, stored_at = false, nil
+    if ngx.var.cache_key ~= nil and ngx.var.cache_key ~= "" and cache_status ~= "" then
+        stored, stored_at = get_response_stored_at(cache_status, now)
+    end
+    local headers = get_freshness_headers(
+        stored,
+        stored_at,
+        now,
+        utils.parse_duration(ngx.var.cache_expire_time)
+    )
+    for name, value in pairs(headers) do
+        ngx.header[name] = value
+    end
+
+    ngx.ctx.inject_cache_metadata = ngx.var.inject_cache_metadata == "1"
+        and ngx.status == ngx.HTTP_OK
+        and (ngx.header["Content-Type"] or ""):find("application/json", 1, true) ~= nil
+        -- compressed responses (CACHE_COMPRESSION=gzip) are not modified
+        and ngx.header["Content-Encoding"] == nil
+    if ngx.ctx.inject_cache_metadata then
+        ngx.header["Content-Length"] = nil
+    end
+end
+
+--- @return CacheMetadata
+local function get_request_metadata()
+    local status = ngx.var.upstream_cache_status or ""
+    local now = ngx.time()
+    local _, stored_at = get_response_stored_at(status, now)
+    local age = nil
+    if stored_at ~= nil then
+        age = now - stored_at
+    elseif not CACHED_STATUSES[status] then
+        -- fetched from grafana
+        age = 0
+    end
+    return {
+        status = status,
+        age = age,
+        key = ngx.var.cache_key,
+        cache_config_id = ngx.var.cache_config_id,
+    }
+end
+
+--- body filter of the query location, buffers the response (up to MAX_CACHEABLE_RESPONSE_SIZE) and injects the metadata.
+--- must run after response_filter.body_filter which inspects the original body
+local function body_filter()
+    if not ngx.ctx.inject_cache_metadata then
+        return
+    end
+    local chunk, eof = ngx.arg[1], ngx.arg[2]
+    local chunks = ngx.ctx.metadata_chunks or {}
+    ngx.ctx.metadata_chunks = chunks
+    table.insert(chunks, chunk)
+    ngx.ctx.metadata_size = (ngx.ctx.metadata_size or 0) + string.len(chunk)
+
+    local max_size = utils.parse_size(ngx.var.max_cacheable_response_size)
+    if max_size ~= nil and ngx.ctx.metadata_size > max_size then
+        -- too large to buffer, sent as it is
+        ngx.ctx.inject_cache_metadata = false
+        ngx.ctx.metadata_chunks = nil
+        ngx.arg[1] = table.concat(chunks)
+        return
+    end
+    if not eof then
+        ngx.arg[1] = nil
+        return
+    end
+    local body = table.concat(chunks)
+    ngx.ctx.metadata_chunks = nil
+    ngx.arg[1] = inject_cache_metadata_into_body(body, get_request_metadata()) or body
+end
+
+return {
+    format_age = format_age,
+    get_freshness_headers = get_freshness_headers,
+    is_response_stored = is_response_stored,
+    get_cache_metadata_notice = get_cache_metadata_notice,
+    inject_cache_metadata = inject_cache_metadata,
+    inject_cache_metadata_into_body = inject_cache_metadata_into_body,
+    header_filter = header_filter,
+    body_filter = body_filter,
+}
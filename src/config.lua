@@ -1,5 +1,7 @@
 local lyaml = require "lyaml"
+local lfs = require "lfs"
 local utils = require "utils"
+local cron = require "cron"
 
 ---@class CacheConfig
 ---@field enabled boolean
@@ -7,47 +9,249 @@ local utils = require "utils"
 ---@field acceptable_time_range_delta_seconds number
 ---@field acceptable_max_points_delta number
 ---@field id? string|number
+---@field invalidate_at? string cron expression (UTC), cached responses of the rule are invalidated at the scheduled times
+---@field inject_cache_metadata? boolean adds the cache status and age to the data frames meta (query inspector)
 CacheConfig = {}
 
 ---@class Config
 ---@field default CacheConfig
 ---@field cache_rules table<number, number|boolean|string>: { [K]: V }
+---@field invalidate_at? string cron expression (UTC), all the cached responses are invalidated at the scheduled times
+---@field label_conflict_policy string first, most_restrictive or disable. used when the queries of a request have different values for a label
+---@field rule_match_mode string first or most_specific. used when several cache rules match the labels of a request
+---@field rule_names? string[] names of the cache rules with their file (`teams/sre.yaml:cache_rules[1]`), set if the rules come from several files
 Config = {}
 
+---@class CacheRule
+---@field panel_selector table<string, string>
+---@field cache_config CacheConfig
+---@field priority? number rules with a higher priority are matched first, default 0
+
+---@class CacheRuleMatch
+---@field rule string matched rule, e.g. `cache_rules[2]`, `teams/sre.yaml:cache_rules[1]` or `default`
+---@field candidates string[] all the rules matching the labels, in the evaluation order
+
+-- rule files of a config directory
+CONFIG_FILE_GLOBS = { "*.yaml", "*.yml" }
+-- settings defined once for all the rule files
+CONFIG_SETTING_KEYS = { "default", "invalidate_at", "label_conflict_policy", "rule_match_mode" }
+
+-- valid values of label_conflict_policy, see get_queries_config in grafana_request.lua
+LABEL_CONFLICT_POLICY_FIRST = "first"
+LABEL_CONFLICT_POLICIES = { LABEL_CONFLICT_POLICY_FIRST, "most_restrictive", "disable" }
+
+-- valid values of rule_match_mode. with both modes the rules with the highest priority win,
+-- then `first` uses the order of the rules and `most_specific` the rules with the most selector labels
+RULE_MATCH_MODE_FIRST = "first"
+RULE_MATCH_MODE_MOST_SPECIFIC = "most_specific"
+RULE_MATCH_MODES = { RULE_MATCH_MODE_FIRST, RULE_MATCH_MODE_MOST_SPECIFIC }
+
+---@class ConfigFile
+---@field path string path of the file, relative to the config directory or to the directory of the main file
+---@field config table parsed and validated config of the file
+
+--- returns the files matching the glob, sorted by name. only the file name part of the glob can contain wildcards
+--- @param glob string
+--- @return string[]|nil files
+--- @return string errorMessage
+function find_files(glob)
+    local directory, file_glob = glob:match("^(.*)/([^/]*)$")
+    if directory == nil then
+        directory, file_glob = ".", glob
+    elseif directory == "" then
+        directory = "/"
+    end
+    if directory:find("[%*%?]") then
+        return nil, "wildcards are only supported in the file name, " .. glob
+    end
+    if not file_glob:find("[%*%?]") then
+        if lfs.attributes(glob, "mode") ~= "file" then
+            return nil, "no such file " .. glob
+        end
+        return { glob }, ""
+    end
+    if lfs.attributes(directory, "mode") ~= "directory" then
+        return nil, "no such directory " .. directory
+    end
+    local pattern = utils.glob_to_pattern(file_glob)
+    local files = {}
+    for name in lfs.dir(directory) do
+        local path = directory == "/" and "/" .. name or directory .. "/" .. name
+        if name:match(pattern) and lfs.attributes(path, "mode") == "file" then
+            table.insert(files, path)
+        end
+    end
+    table.sort(files)
+    return files, ""
+end
+
+--- @param file_path string
+--- @param display_path string path shown in the error messages
+--- @return ConfigFile|nil
+--- @return string errorMessage
+local function read_config_file(file_path, display_path)
+    local file, err_msg = io.open(file_path, "rb")
+    if file == nil then
+        return nil, "unable to open config file, ERR: " .. err_msg
+    end
+    local config_data = file:read("a")
+    io.close(file)
+    local ok, parsed_config, parse_err_msg = pcall(parse_and_validate_config, config_data)
+    if not ok then
+        parsed_config, parse_err_msg = nil, tostring(parsed_config)
+    end
+    if parsed_config == nil then
+        return nil, string.format("config parse and validation failed, ERR: %s: %s", display_path, parse_err_msg)
+    end
+    return { path = display_path, config = parsed_config }, ""
+end
+
+--- returns the rule files of the config path, the rule files of a directory or the file and its includes
+--- @param config_path string
+--- @return ConfigFile[]|nil
+--- @return string errorMessage
+local function read_config_files(config_path)
+    local config_files = {}
+    local directory = config_path:match("^(.*)/[^/]*$") or "."
+    local file_paths = {}
+    if lfs.attributes(config_path, "mode") == "directory" then
+        directory = config_path:gsub("/+$", "")
+        for _, glob in ipairs(CONFIG_FILE_GLOBS) do
+            local files = find_files(directory .. "/" .. glob)
+            for _, file_path in ipairs(files or {}) do
+                table.insert(file_paths, file_path)
+            end
+        end
+        table.sort(file_paths)
+        if #file_paths == 0 then
+            return nil, "no rule file in the config directory " .. config_path
+        end
+    else
+        local main_file, err_msg = read_config_file(config_path, config_path:match("([^/]*)$"))
+        if main_file == nil then
+            return nil, err_msg
+        end
+        table.insert(config_files, main_file)
+        for _, glob in ipairs(main_file.config.include or {}) do
+            if glob:sub(1, 1) ~= "/" then
+                glob = directory .. "/" .. glob
+            end
+            local files, find_err_msg = find_files(glob)
+            if files == nil then
+                return nil, string.format("invalid include of %s: %s", config_path, find_err_msg)
+            end
+            for _, file_path in ipairs(files) do
+                if not utils.table_contains(file_paths, file_path) then
+                    table.insert(file_paths, file_path)
+                end
+            end
+        end
+    end
+
+    for _, file_path in ipairs(file_paths) do
+        local display_path = file_path
+        if file_path:sub(1, directory:len() + 1) == directory .. "/" then
+            display_path = file_path:sub(directory:len() + 2)
+        end
+        local config_file, err_msg = read_config_file(file_path, display_path)
+        if config_file == nil then
+            return nil, err_msg
+        end
+        if config_file.config.include ~= nil then
+            return nil, string.format("%s: include is only supported in the main config file", display_path)
+        end
+        table.insert(config_files, config_file)
+    end
+    return config_files, ""
+end
+
+--- merges the rule files, the cache rules are appended in the file order.
+--- the settings (default, invalidate_at, ...) can only be defined in one file
+--- @param config_files ConfigFile[]
+--- @return table|nil config merged config with `rule_names` set if there are several files
+--- @return string errorMessage
+function merge_config_files(config_files)
+    local merged = { cache_rules = {}, rule_names = {} }
+    local setting_files = {}
+    for _, config_file in ipairs(config_files) do
+        for _, key in ipairs(CONFIG_SETTING_KEYS) do
+            if config_file.config[key] ~= nil then
+                if setting_files[key] ~= nil then
+                    return nil, string.format("%s is defined in %s and %s", key, setting_files[key], config_file.path)
+                end
+                setting_files[key] = config_file.path
+                merged[key] = config_file.config[key]
+            end
+        end
+        for index, cache_rule in ipairs(config_file.config.cache_rules or {}) do
+            table.insert(merged.cache_rules, cache_rule)
+            table.insert(merged.rule_names, string.format("%s:cache_rules[%d]", config_file.path, index))
+        end
+    end
+    if #config_files == 1 then
+        merged.rule_names = nil
+    end
+    return merged, ""
+end
+
 ---@param self Config
----@param config_file_path string
+---@param config_path string rule file or directory of rule files
 ---@return Config|nil config
 ---@return string errorMessage
-function Config:New(config_file_path)
+function Config:New(config_path)
     local config = {}
     setmetatable(config, self)
     self.__index = self
 
-    local file, err_msg = io.open(config_file_path, "rb")
-    if file == nil then
-        return nil, "unable to open config file, ERR: " .. err_msg
+    local config_files, err_msg = read_config_files(config_path)
+    if config_files == nil then
+        return nil, err_msg
     end
-
-    local config_data = file:read("a")
-    io.close(file)
-    local parsed_config, err_msg = parse_and_validate_config(config_data)
-    if parsed_config == nil then
-        return nil, "config parse and validation failed, ERR: " .. err_msg
+    local merged_config, merge_err_msg = merge_config_files(config_files)
+    if merged_config == nil then
+        return nil, "config merge failed, ERR: " .. merge_err_msg
     end
 
-    self.default = parsed_config.default
-    self.cache_rules = parsed_config.cache_rules
+    -- set on the instance, the upstream configs are loaded along with the global config
+    config.default = merged_config.default
+    config.cache_rules = merged_config.cache_rules
+    config.rule_names = merged_config.rule_names
+    config.invalidate_at = merged_config.invalidate_at
+    config.label_conflict_policy = merged_config.label_conflict_policy or LABEL_CONFLICT_POLICY_FIRST
+    config.rule_match_mode = merged_config.rule_match_mode or RULE_MATCH_MODE_FIRST
     return config, ""
 end
 
+--- returns true if the cache rule `a` is evaluated before `b`
+--- @param a { index: number, rule: CacheRule }
+--- @param b { index: number, rule: CacheRule }
+--- @param rule_match_mode string
+--- @return boolean
+function is_rule_evaluated_before(a, b, rule_match_mode)
+    local a_priority, b_priority = a.rule["priority"] or 0, b.rule["priority"] or 0
+    if a_priority ~= b_priority then
+        return a_priority > b_priority
+    end
+    if rule_match_mode == RULE_MATCH_MODE_MOST_SPECIFIC then
+        local a_length = utils.table_length(a.rule["panel_selector"])
+        local b_length = utils.table_length(b.rule["panel_selector"])
+        if a_length ~= b_length then
+            return a_length > b_length
+        end
+    end
+    return a.index < b.index
+end
+
 --- returns cache config for the input labels, by default returns default cache config if labels do not match any rule.
 --- @param query_labels table
 --- @return CacheConfig
+--- @return CacheRuleMatch
 function Config:get_cache_config(query_labels)
     if utils.table_length(query_labels) == 0 then
-        return self.default
+        return self.default, { rule = "default", candidates = {} }
     end
-    for _, cache_rule in pairs(self.cache_rules) do
+    local matched_rules = {}
+    for index, cache_rule in ipairs(self.cache_rules or {}) do
         local all_labels_matched = true
         for key, value in pairs(cache_rule["panel_selector"]) do
             if query_labels[key] ~= value then
@@ -55,34 +259,152 @@ function Config:get_cache_config(query_labels)
             end
         end
         if all_labels_matched == true then
-            return cache_rule["cache_config"]
+            table.insert(matched_rules, { index = index, rule = cache_rule })
+        end
+    end
+    if #matched_rules == 0 then
+        return self.default, { rule = "default", candidates = {} }
+    end
+    local rule_match_mode = self.rule_match_mode or RULE_MATCH_MODE_FIRST
+    table.sort(matched_rules, function(a, b)
+        return is_rule_evaluated_before(a, b, rule_match_mode)
+    end)
+    local candidates = {}
+    for _, matched_rule in ipairs(matched_rules) do
+        local rule_name = self.rule_names and self.rule_names[matched_rule.index]
+        table.insert(candidates, rule_name or string.format("cache_rules[%d]", matched_rule.index))
+    end
+    return matched_rules[1].rule["cache_config"], { rule = candidates[1], candidates = candidates }
+end
+
+--- expands the environment variables of a string value of the config file.
+--- `${VAR}` and `${VAR:?message}` are required, `${VAR:-default}` uses the default if VAR is unset or empty, `$${` is a literal `${`
+--- @usage interpolate_variables("${DELTA:-60}s", os.getenv) -- "60s"
+--- @param data string
+--- @param getenv fun(name: string): string|nil
+--- @return string|nil data
+--- @return string errorMessage
+function interpolate_variables(data, getenv)
+    local errors = {}
+    local result = data:gsub("%$(%$?)(%b{})", function(escape, expression)
+        if escape == "$" then
+            return "$" .. expression
+        end
+        local name, operator = expression:match("^{([%a_][%w_]*)(.*)}$")
+        if name == nil or (operator ~= "" and operator:sub(1, 2) ~= ":-" and operator:sub(1, 2) ~= ":?") then
+            table.insert(errors, "invalid variable $" .. expression)
+            return ""
+        end
+        local value = getenv(name)
+        if operator:sub(1, 2) == ":-" then
+            if value == nil or value == "" then
+                return operator:sub(3)
+            end
+            return value
+        end
+        if operator:sub(1, 2) == ":?" and (value == nil or value == "") then
+            local message = operator:sub(3)
+            if message == "" then
+                message = "required"
+            end
+            table.insert(errors, string.format("variable %s: %s", name, message))
+            return ""
+        end
+        if value == nil then
+            table.insert(errors, "undefined variable " .. name)
+            return ""
         end
+        return value
+    end)
+    if #errors > 0 then
+        return nil, table.concat(errors, ", ")
     end
-    return self.default
+    return result, ""
+end
+
+--- expands the environment variables of the string values of the parsed config file, so the comments are ignored
+--- and the values can't change the YAML structure. keys are not expanded.
+--- a value made of a single variable gets the type of the expanded value like a plain YAML scalar (number or boolean),
+--- e.g. `acceptable_max_points_delta: ${MAX_POINTS_DELTA}`
+--- @param value any parsed config
+--- @param getenv fun(name: string): string|nil
+--- @return any value
+--- @return string errorMessage
+function interpolate_config_variables(value, getenv)
+    if type(value) == "table" then
+        local errors = {}
+        for key, item in pairs(value) do
+            local interpolated, errorMessage = interpolate_config_variables(item, getenv)
+            if errorMessage ~= "" then
+                table.insert(errors, errorMessage)
+            else
+                value[key] = interpolated
+            end
+        end
+        if #errors > 0 then
+            table.sort(errors)
+            return nil, table.concat(errors, ", ")
+        end
+        return value, ""
+    end
+    if type(value) ~= "string" or value:find("${", 1, true) == nil then
+        return value, ""
+    end
+    local interpolated, errorMessage = interpolate_variables(value, getenv)
+    if interpolated == nil then
+        return nil, errorMessage
+    end
+    if value:match("^%$%b{}$") == nil then
+        return interpolated, ""
+    end
+    if interpolated == "true" or interpolated == "false" then
+        return interpolated == "true", ""
+    end
+    if interpolated:match("^%-?%d+%.?%d*$") ~= nil then
+        return tonumber(interpolated), ""
+    end
+    return interpolated, ""
 end
 
 --- @param config_data string
+--- @param getenv? fun(name: string): string|nil environment of the variables, default os.getenv
 --- @return Config|nil config
 --- @return string errorMessage
-function parse_and_validate_config(config_data)
+function parse_and_validate_config(config_data, getenv)
     -- check if it has default
     -- default is optional
-    -- either default or cache_rules required
+    -- either default, cache_rules or include required
     local config = lyaml.load(config_data)
     if type(config) ~= "table" then
         return nil, "invalid config type " .. type(config)
     end
+    local interpolation_err_msg
+    config, interpolation_err_msg = interpolate_config_variables(config, getenv or os.getenv)
+    if config == nil then
+        return nil, "invalid variables " .. interpolation_err_msg
+    end
 
-    if type(config["default"]) ~= "table" and type(config["cache_rules"]) ~= "table" then
+    if type(config["default"]) ~= "table" and type(config["cache_rules"]) ~= "table" and config["include"] == nil then
         error("either default and cache_rules both are missing or they have invalid types " ..
             type(config["default"]) .. " " .. type(config["cache_rules"]))
     end
 
+    if config["include"] ~= nil then
+        local valid = type(config["include"]) == "table"
+        for _, glob in ipairs(valid and config["include"] or {}) do
+            valid = valid and type(glob) == "string" and string.len(glob) > 0
+        end
+        if not valid then
+            return nil, "include should be a list of file paths or globs"
+        end
+    end
+
     if (type(config["default"])) == "table" then
         local valid, message = validate_cache_config_key(config["default"])
         if valid == false then
             return nil, "invalid default config " .. message
         end
+        normalize_cache_config(config["default"])
     end
 
     if type(config["cache_rules"]) == "table" then
@@ -90,11 +412,38 @@ function parse_and_validate_config(config_data)
         if valid == false then
             return nil, "invalid default config " .. message
         end
+        for _, cache_rule in pairs(config["cache_rules"]) do
+            normalize_cache_config(cache_rule["cache_config"])
+        end
+    end
+
+    if config["invalidate_at"] ~= nil then
+        local schedule, message = cron.parse_cron_expression(config["invalidate_at"])
+        if schedule == nil then
+            return nil, "invalid invalidate_at " .. message
+        end
+    end
+
+    -- the default values of the settings are set once the rule files are merged (see Config:New)
+    local label_conflict_policy = config["label_conflict_policy"]
+    if label_conflict_policy ~= nil and not utils.table_contains(LABEL_CONFLICT_POLICIES, label_conflict_policy) then
+        return nil, "invalid label_conflict_policy " .. tostring(label_conflict_policy) ..
+            ", valid values are: " .. table.concat(LABEL_CONFLICT_POLICIES, ", ")
+    end
+
+    local rule_match_mode = config["rule_match_mode"]
+    if rule_match_mode ~= nil and not utils.table_contains(RULE_MATCH_MODES, rule_match_mode) then
+        return nil, "invalid rule_match_mode " .. tostring(rule_match_mode) ..
+            ", valid values are: " .. table.concat(RULE_MATCH_MODES, ", ")
     end
 
     return {
         default = config["default"],
-        cache_rules = config["cache_rules"]
+        cache_rules = config["cache_rules"],
+        invalidate_at = config["invalidate_at"],
+        label_conflict_policy = label_conflict_policy,
+        rule_match_mode = rule_match_mode,
+        include = config["include"]
     }, ""
 end
 
@@ -106,6 +455,7 @@ function validate_cache_rules_key(cache_rules)
         local is_valid, message = utils.check_table_type(cache_config, {
             { key = "panel_selector", type = "table" },
             { key = "cache_config",   type = "table" },
+            { key = "priority",       type = "number", required = false },
         })
         if is_valid == false then
             return false, string.format("%d[st/nd/th] entry in cache_config invalid type. message: %s", index, message)
@@ -142,43 +492,97 @@ function validate_panel_selector_key(panel_selector)
     return true, ""
 end
 
+-- keys of the cache config accepting a duration (`30m`, `1h30m`, `1.5h`) or a number of seconds.
+-- acceptable_max_points_delta is a number of points, not a size, so the nginx size units (k = 1024) are not accepted
+CACHE_CONFIG_DURATION_KEYS = { "acceptable_time_delta_seconds", "acceptable_time_range_delta_seconds" }
+
+--- converts the durations of the validated cache config to seconds
+--- @param config CacheConfig
+function normalize_cache_config(config)
+    for _, key in ipairs(CACHE_CONFIG_DURATION_KEYS) do
+        config[key] = utils.parse_duration(config[key])
+    end
+end
+
+--- validates the cache config, the input is not modified (see normalize_cache_config)
 --- @param config CacheConfig
 --- @return boolean valid
 --- @return string errorMessage
 function validate_cache_config_key(config)
-    return utils.check_table_type(
+    local valid, message = utils.check_table_type(
         config, {
             { key = "enabled",                             type = "boolean" },
-            { key = "acceptable_time_delta_seconds",       type = "number" },
-            { key = "acceptable_time_range_delta_seconds", type = "number" },
+            { key = "acceptable_time_delta_seconds",       type = "number|string" },
+            { key = "acceptable_time_range_delta_seconds", type = "number|string" },
             { key = "acceptable_max_points_delta",         type = "number" },
             { key = "id",                                  type = "number|string", required = false },
+            { key = "invalidate_at",                       type = "string", required = false },
+            { key = "inject_cache_metadata",               type = "boolean", required = false },
         })
+    if valid == false then
+        return valid, message
+    end
+    for _, key in ipairs(CACHE_CONFIG_DURATION_KEYS) do
+        if utils.parse_duration(config[key]) == nil then
+            return false, string.format("key = \"%s\", invalid duration %s, expected e.g. 30m or 1h30m", key, config[key])
+        end
+    end
+    if config["invalidate_at"] == nil then
+        return true, ""
+    end
+    -- the invalidation generation is stored by id
+    if config["id"] == nil then
+        return false, "id is required with invalidate_at"
+    end
+    local schedule, errorMessage = cron.parse_cron_expression(config["invalidate_at"])
+    if schedule == nil then
+        return false, "invalid invalidate_at " .. errorMessage
+    end
+    return true, ""
 end
 
 ---in context of nginx, this will be loaded only once during the first require
 ---@type Config|nil
 GloablConfig = nil
 
+---configs of the grafana upstreams (see grafana_upstreams.lua) by upstream name
+---@type table<string, Config>
+UpstreamConfigs = {}
+
 ---loads the input config file in memory 
 ---@param config_file_path string
+---@param upstream_name? string loads the config of the grafana upstream instead of the global config
 ---@return string|nil errorMessage
-function load_config(config_file_path)
+function load_config(config_file_path, upstream_name)
     local config, errorMessage = Config:New(config_file_path)
     if config == nil then
         return "unable to load config file " .. errorMessage
     end
+    if upstream_name ~= nil then
+        UpstreamConfigs[upstream_name] = config
+        return nil
+    end
     GloablConfig = config
     return nil
 end
 
+---@param upstream_name? string $grafana_upstream_name, empty for the default grafana upstream
 ---@return Config|nil
-function get_config()
+function get_config(upstream_name)
+    if upstream_name ~= nil and upstream_name ~= "" then
+        return UpstreamConfigs[upstream_name]
+    end
     return GloablConfig
 end
 
+---@return table<string, Config> configs by grafana upstream name
+function get_upstream_configs()
+    return UpstreamConfigs
+end
+
 return {
     config = GloablConfig,
     get_config = get_config,
+    get_upstream_configs = get_upstream_configs,
     load_config = load_config
 }
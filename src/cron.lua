@@ -0,0 +1,188 @@
+-- minimal cron expression parser, used by the scheduled invalidation (invalidate_at).
+-- supports the 5 standard fields (minute hour day-of-month month day-of-week) with
+-- `*`, numbers, lists (1,2), ranges (1-5) and steps (*/15, 1-30/5), plus the @hourly/@daily/@weekly/@monthly/@yearly macros.
+-- expressions are evaluated in UTC.
+
+CRON_MACROS = {
+    ["@yearly"] = "0 0 1 1 *",
+    ["@annually"] = "0 0 1 1 *",
+    ["@monthly"] = "0 0 1 * *",
+    ["@weekly"] = "0 0 * * 0",
+    ["@daily"] = "0 0 * * *",
+    ["@midnight"] = "0 0 * * *",
+    ["@hourly"] = "0 * * * *",
+}
+
+SECONDS_PER_DAY = 24 * 60 * 60
+
+CRON_FIELDS = {
+    { name = "minute",       min = 0, max = 59 },
+    { name = "hour",         min = 0, max = 23 },
+    { name = "day_of_month", min = 1, max = 31 },
+    { name = "month",        min = 1, max = 12 },
+    -- 0 and 7 are sunday
+    { name = "day_of_week",  min = 0, max = 7 },
+}
+
+---@class CronSchedule
+---@field minute table<number, boolean>
+---@field hour table<number, boolean>
+---@field day_of_month table<number, boolean>
+---@field month table<number, boolean>
+---@field day_of_week table<number, boolean>
+---@field day_of_month_any boolean
+---@field day_of_week_any boolean
+
+--- @param field string
+--- @param min number
+--- @param max number
+--- @return table<number, boolean>|nil values
+--- @return string errorMessage
+local function parse_field(field, min, max)
+    local values = {}
+    for item in string.gmatch(field, "[^,]+") do
+        local range, step = item:match("^([^/]+)/(%d+)$")
+        if range == nil then
+            range = item
+        end
+        step = tonumber(step) or 1
+        local from, to
+        if range == "*" then
+            from, to = min, max
+        elseif range:match("^%d+$") then
+            from = tonumber(range)
+            -- 5/10 is 5-max/10
+            to = item:find("/") and max or from
+        else
+            from, to = range:match("^(%d+)-(%d+)$")
+            from, to = tonumber(from), tonumber(to)
+        end
+        if from == nil or to == nil or step == 0 or from < min or to > max or from > to then
+            return nil, string.format("invalid value \"%s\", expected values between %d and %d", item, min, max)
+        end
+        for value = from, to, step do
+            values[value] = true
+        end
+    end
+    if next(values) == nil then
+        return nil, string.format("empty field \"%s\"", field)
+    end
+    return values, ""
+end
+
+--- @param expression string
+--- @return CronSchedule|nil schedule
+--- @return string errorMessage
+function parse_cron_expression(expression)
+    if type(expression) ~= "string" then
+        return nil, "cron expression should be a string"
+    end
+    expression = expression:gsub("^%s+", ""):gsub("%s+$", "")
+    expression = CRON_MACROS[expression] or expression
+    local fields = {}
+    for field in expression:gmatch("%S+") do
+        table.insert(fields, field)
+    end
+    if #fields ~= #CRON_FIELDS then
+        return nil, string.format("invalid cron expression \"%s\", expected %d fields", expression, #CRON_FIELDS)
+    end
+    local schedule = {}
+    for index, field_config in ipairs(CRON_FIELDS) do
+        local values, errorMessage = parse_field(fields[index], field_config.min, field_config.max)
+        if values == nil then
+            return nil, string.format("invalid cron %s field: %s", field_config.name, errorMessage)
+        end
+        schedule[field_config.name] = values
+    end
+    if schedule.day_of_week[7] then
+        schedule.day_of_week[0] = true
+    end
+    -- standard cron: if both day fields are restricted, either of them has to match
+    schedule.day_of_month_any = fields[3] == "*"
+    schedule.day_of_week_any = fields[5] == "*"
+    return schedule, ""
+end
+
+--- checks the day of month and day of week fields
+--- @param schedule CronSchedule
+--- @param t table os.date("!*t")
+--- @return boolean
+local function matches_day(schedule, t)
+    local day_of_month_match = schedule.day_of_month[t.day] == true
+    local day_of_week_match = schedule.day_of_week[t.wday - 1] == true
+    if schedule.day_of_month_any or schedule.day_of_week_any then
+        return day_of_month_match and day_of_week_match
+    end
+    return day_of_month_match or day_of_week_match
+end
+
+--- @param schedule CronSchedule
+--- @param timestamp number unix timestamp, seconds are ignored
+--- @return boolean
+function matches_cron_schedule(schedule, timestamp)
+    local t = os.date("!*t", timestamp)
+    if not schedule.minute[t.min] or not schedule.hour[t.hour] or not schedule.month[t.month] then
+        return false
+    end
+    return matches_day(schedule, t)
+end
+
+--- returns the latest scheduled minute of the day up to latest
+--- @param schedule CronSchedule
+--- @param day number unix timestamp of the start of the day (UTC)
+--- @param latest number unix timestamp in the day, minute precision
+--- @return number|nil timestamp
+local function get_latest_run_of_day(schedule, day, latest)
+    local latest_hour = math.floor((latest - day) / 3600)
+    for hour = latest_hour, 0, -1 do
+        if schedule.hour[hour] then
+            local latest_minute = 59
+            if hour == latest_hour then
+                latest_minute = math.floor((latest - day) % 3600 / 60)
+            end
+            for minute = latest_minute, 0, -1 do
+                if schedule.minute[minute] then
+                    return day + hour * 3600 + minute * 60
+                end
+            end
+        end
+    end
+    return nil
+end
+
+--- returns the latest scheduled time in (from, to].
+--- the days are checked from the latest one, months which don't match are skipped and
+--- only the hours and minutes of the matching days are checked
+--- @param schedule CronSchedule
+--- @param from number unix timestamp, exclusive
+--- @param to number unix timestamp, inclusive
+--- @return number|nil timestamp returns `nil` if the schedule didn't match in the interval
+function get_latest_scheduled_run(schedule, from, to)
+    -- latest minute to check and the start of its day
+    local latest = to - to % 60
+    local day = latest - latest % SECONDS_PER_DAY
+    while latest > from do
+        local t = os.date("!*t", day)
+        if not schedule.month[t.month] then
+            -- continues with the last day of the previous month
+            day = day - (t.day - 1) * SECONDS_PER_DAY
+        elseif matches_day(schedule, t) then
+            local run = get_latest_run_of_day(schedule, day, latest)
+            if run ~= nil then
+                if run > from then
+                    return run
+                end
+                return nil
+            end
+        end
+        latest = day - 60
+        day = day - SECONDS_PER_DAY
+    end
+    return nil
+end
+
+return {
+    parse_cron_expression = parse_cron_expression,
+    matches_cron_schedule = matches_cron_schedule,
+    get_latest_scheduled_run = get_latest_scheduled_run,
+}
@@ -0,0 +1,277 @@
+-- requests sent to grafana by the proxy (datasource access checks, grafana admin check).
+-- the requests use the peers of the grafana_server upstream (GRAFANA_HOST), peers marked down by the
+-- active health check are skipped and the next peer is tried on connect failure.
+-- the TLS options (GRAFANA_CA_FILE, GRAFANA_CLIENT_CERT/KEY, GRAFANA_TLS_SERVER_NAME) match the proxy_ssl_* directives.
+local utils = require "utils"
+
+GRAFANA_UPSTREAM_NAME = "grafana_server"
+GRAFANA_HEALTH_CHECK_SHARED_DICT = "grafana_health_check"
+GRAFANA_HEALTH_CHECK_TIMEOUT_MILLISECONDS = 1000
+-- consecutive failures/successes before a peer is marked down/up
+GRAFANA_HEALTH_CHECK_FALL = 3
+GRAFANA_HEALTH_CHECK_RISE = 2
+
+---@class GrafanaClientOptions
+---@field health_check_enabled boolean
+---@field health_check_path string e.g. /api/health
+---@field health_check_interval string nginx style duration
+---@field host string Host header of the health check requests
+---@field scheme string http or https
+---@field ssl_verify boolean GRAFANA_TLS_VERIFY, verifies the grafana certificate using lua_ssl_trusted_certificate (system CAs and GRAFANA_CA_FILE)
+---@field tls_server_name string GRAFANA_TLS_SERVER_NAME, server name of the health check requests. default is the host of `host`
+---@field client_cert_file string GRAFANA_CLIENT_CERT
+---@field client_key_file string GRAFANA_CLIENT_KEY
+
+---@type GrafanaClientOptions
+local options = {
+    health_check_enabled = false,
+    health_check_path = "/api/health",
+    health_check_interval = "5s",
+    host = "",
+    scheme = "http",
+    ssl_verify = true,
+    tls_server_name = "",
+    client_cert_file = "",
+    client_key_file = "",
+}
+
+-- pem encoded client certificate and key read in init_by_lua, parsed once per worker
+local client_cert_pem = nil
+local client_key_pem = nil
+local client_cert = nil
+local client_key = nil
+
+-- round robin offset of the worker
+local next_peer = 0
+
+---@class GrafanaPeer
+---@field name string address of the peer, e.g. 10.0.0.2:3000
+---@field down boolean|nil set by the health check
+
+--- returns the addresses of the peers in the order they should be tried, starting at the offset.
+--- all the peers are returned if every peer is down, so a failing health check doesn't block the access checks
+--- @param peers GrafanaPeer[]
+--- @param offset number
+--- @return string[]
+function get_peer_order(peers, offset)
+    local live_peers = {}
+    for _, peer in ipairs(peers) do
+        if not peer.down then
+            table.insert(live_peers, peer.name)
+        end
+    end
+    if #live_peers == 0 then
+        for _, peer in ipairs(peers) do
+            table.insert(live_peers, peer.name)
+        end
+    end
+    local ordered = {}
+    for i = 1, #live_peers do
+        table.insert(ordered, live_peers[((offset + i - 1) % #live_peers) + 1])
+    end
+    return ordered
+end
+
+--- @param address string host[:port] or [ipv6][:port]
+--- @param scheme string
+--- @return string|nil host
+--- @return number|nil port
+function parse_peer_address(address, scheme)
+    if type(address) ~= "string" then
+        return nil, nil
+    end
+    local default_port = 80
+    if scheme == "https" then
+        default_port = 443
+    end
+    local host, port = address:match("^%[([%x:]+)%]:?(%d*)$")
+    if host == nil then
+        host, port = address:match("^([^:]+):?(%d*)$")
+    end
+    if host == nil or string.len(host) == 0 then
+        return nil, nil
+    end
+    return host, tonumber(port) or default_port
+end
+
+--- returns the peers of the request, the grafana upstreams of GRAFANA_UPSTREAMS_FILE only have one peer
+--- @return string[]
+local function get_request_peers()
+    if ngx.var.grafana_upstream ~= GRAFANA_UPSTREAM_NAME then
+        return { ngx.var.grafana_host }
+    end
+    local upstream = require "ngx.upstream"
+    local peers, err = upstream.get_primary_peers(GRAFANA_UPSTREAM_NAME)
+    if peers == nil then
+        ngx.log(ngx.STDERR, "unable to get the peers of ", GRAFANA_UPSTREAM_NAME, ": ", err)
+        return { ngx.var.grafana_host }
+    end
+    next_peer = next_peer + 1
+    return get_peer_order(peers, next_peer)
+end
+
+--- @param file_path string
+--- @return string
+local function read_file(file_path)
+    local file, err = io.open(file_path, "rb")
+    if file == nil then
+        error("unable to open " .. file_path .. ": " .. tostring(err))
+    end
+    local content = file:read("*all")
+    file:close()
+    return content
+end
+
+--- returns the parsed client certificate and key, `nil` if GRAFANA_CLIENT_CERT is not set
+--- @return any|nil cert
+--- @return any|nil key
+local function get_client_cert()
+    if client_cert_pem == nil or client_cert ~= nil then
+        return client_cert, client_key
+    end
+    local ssl = require "ngx.ssl"
+    local cert, err = ssl.parse_pem_cert(client_cert_pem)
+    if cert == nil then
+        ngx.log(ngx.STDERR, "unable to parse the grafana client certificate: ", err)
+        return nil, nil
+    end
+    local key, key_err = ssl.parse_pem_priv_key(client_key_pem)
+    if key == nil then
+        ngx.log(ngx.STDERR, "unable to parse the grafana client key: ", key_err)
+        return nil, nil
+    end
+    client_cert, client_key = cert, key
+    return client_cert, client_key
+end
+
+---@class GrafanaResponse
+---@field status number
+---@field body string|nil
+
+--- sends a GET request to grafana, the next peer is tried if the connection fails.
+--- requests are only retried before they are sent, the Host header is the grafana host
+--- @param path string e.g. /api/user
+--- @param headers table<string, string>
+--- @return GrafanaResponse|nil response
+--- @return string errorMessage
+local function get(path, headers)
+    local http = require "resty.http"
+    local scheme = ngx.var.grafana_scheme
+    local grafana_host = ngx.var.grafana_host
+    headers["Host"] = grafana_host
+    local cert, key = get_client_cert()
+
+    local errorMessage = "no grafana peer"
+    for _, address in ipairs(get_request_peers()) do
+        local host, port = parse_peer_address(address, scheme)
+        local http_client = http.new()
+        local connected, err = http_client:connect({
+            scheme = scheme,
+            host = host,
+            port = port,
+            ssl_server_name = ngx.var.grafana_tls_server_name,
+            ssl_verify = options.ssl_verify,
+            ssl_client_cert = cert,
+            ssl_client_priv_key = key,
+        })
+        if connected then
+            local res, request_err = http_client:request({ method = "GET", path = path, headers = headers })
+            if res == nil then
+                http_client:close()
+                return nil, string.format("request to %s failed: %s", address, tostring(request_err))
+            end
+            local body, body_err = res:read_body()
+            if body == nil then
+                http_client:close()
+                return nil, string.format("unable to read the response of %s: %s", address, tostring(body_err))
+            end
+            http_client:set_keepalive()
+            return { status = res.status, body = body }, ""
+        end
+        errorMessage = string.format("unable to connect to %s: %s", address, tostring(err))
+        ngx.log(ngx.WARN, errorMessage, ", trying the next grafana peer")
+    end
+    return nil, errorMessage
+end
+
+--- returns the input options merged with the default options, the tls server name defaults to the host of `host`
+--- @param input_options table
+--- @param default_options GrafanaClientOptions
+--- @return GrafanaClientOptions|nil
+--- @return string errorMessage
+function get_client_options(input_options, default_options)
+    local merged = {}
+    for key, value in pairs(default_options) do
+        merged[key] = value
+    end
+    for key, value in pairs(input_options) do
+        merged[key] = value
+    end
+    if merged.scheme ~= "http" and merged.scheme ~= "https" then
+        return nil, "invalid grafana scheme " .. tostring(merged.scheme) .. ", valid values are: http and https"
+    end
+    if (string.len(merged.client_cert_file) == 0) ~= (string.len(merged.client_key_file) == 0) then
+        return nil, "the grafana client certificate and key must be set together"
+    end
+    if string.len(merged.tls_server_name) == 0 then
+        merged.tls_server_name = parse_peer_address(merged.host, merged.scheme) or ""
+    end
+    if not merged.health_check_enabled then
+        return merged, ""
+    end
+    if utils.parse_duration(merged.health_check_interval) == nil then
+        return nil, "invalid grafana health check interval " .. tostring(merged.health_check_interval)
+    end
+    if type(merged.health_check_path) ~= "string" or merged.health_check_path:sub(1, 1) ~= "/" then
+        return nil, "invalid grafana health check path " .. tostring(merged.health_check_path)
+    end
+    return merged, ""
+end
+
+--- validates the options and reads the client certificate, called in init_by_lua
+--- @param input_options table
+local function init(input_options)
+    local merged, errorMessage = get_client_options(input_options, options)
+    if merged == nil then
+        error(errorMessage)
+    end
+    options = merged
+    if string.len(options.client_cert_file) ~= 0 then
+        client_cert_pem = read_file(options.client_cert_file)
+        client_key_pem = read_file(options.client_key_file)
+    end
+end
+
+--- starts the active health check of the grafana_server upstream, called in init_worker_by_lua.
+--- the health check requests don't send the client certificate
+local function start()
+    if not options.health_check_enabled then
+        return
+    end
+    local healthcheck = require "resty.upstream.healthcheck"
+    local ok, err = healthcheck.spawn_checker({
+        shm = GRAFANA_HEALTH_CHECK_SHARED_DICT,
+        upstream = GRAFANA_UPSTREAM_NAME,
+        type = options.scheme,
+        http_req = string.format("GET %s HTTP/1.0\r\nHost: %s\r\n\r\n", options.health_check_path, options.host),
+        host = options.tls_server_name,
+        ssl_verify = options.ssl_verify,
+        interval = utils.parse_duration(options.health_check_interval) * 1000,
+        timeout = GRAFANA_HEALTH_CHECK_TIMEOUT_MILLISECONDS,
+        fall = GRAFANA_HEALTH_CHECK_FALL,
+        rise = GRAFANA_HEALTH_CHECK_RISE,
+        valid_statuses = { 200 },
+    })
+    if not ok then
+        ngx.log(ngx.STDERR, "failed to start the grafana health check: ", err)
+    end
+end
+
+return {
+    get_peer_order = get_peer_order,
+    parse_peer_address = parse_peer_address,
+    get_client_options = get_client_options,
+    get = get,
+    init = init,
+    start = start,
+}
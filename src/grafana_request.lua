@@ -1,6 +1,8 @@
 local json = require "cjson";
 local md5 = require "md5";
 local utils = require "utils"
+local tracing = require "tracing"
+local grafana_client = require "grafana_client"
 
 -- get_datasource_uids
 --- @param queries table
@@ -155,28 +157,15 @@ function get_cache_key_and_datasource_uids(parsed_request_body, acceptable_time_
   return cache_key, data_sources, errorMessage
 end
 
---- check_user_access returns true if the user has access to all the datasources
---- @param grafana_base_url string
+--- check_user_access returns true if the user has access to all the datasources,
+--- the requests are sent to the grafana upstream of the request (see grafana_client.lua)
 --- @param data_sources table
 --- @param cookie_header_value string
 --- @param authorization_header_value string
 --- @return boolean user_access
 --- @return string errorMessage
-function check_user_access(grafana_base_url, data_sources, cookie_header_value, authorization_header_value)
-  local http = require "resty.http"
-  local http_client = http.new()
-
-  if string.len(grafana_base_url) == 0 then
-    return false, "empty grafana base url"
-  end
-
+function check_user_access(data_sources, cookie_header_value, authorization_header_value)
   for _, data_source in pairs(data_sources) do
-    local request_url = grafana_base_url
-    if request_url:sub(-1) == "/" then
-      request_url = request_url .. "/"
-    end
-    request_url = request_url .. string.format("/api/datasources/uid/%s", data_source)
-
     local request_headeres = {}
     if string.len(cookie_header_value) ~= 0 then
       request_headeres["Cookie"] = cookie_header_value
@@ -185,13 +174,15 @@ function check_user_access(grafana_base_url, data_sources, cookie_header_value,
       request_headeres["Authorization"] = authorization_header_value
     end
 
-    local res, err = http_client:request_uri(request_url, {
-      method = "GET",
-      headers = request_headeres
-    })
-    if err ~= nil or res == nil then
-      return false, "got nil response"
+    local span = tracing.start_span("GET /api/datasources/uid", SPAN_KIND_CLIENT)
+    request_headeres[TRACEPARENT_HEADER] = tracing.get_traceparent(span)
+
+    local res, err = grafana_client.get(string.format("/api/datasources/uid/%s", data_source), request_headeres)
+    if res == nil then
+      tracing.finish_span(span, { ["grafana.datasource_uid"] = data_source }, "got nil response")
+      return false, "got nil response: " .. err
     end
+    tracing.finish_span(span, { ["grafana.datasource_uid"] = data_source, ["http.response.status_code"] = res.status })
     if res.status == nil or type(res.status) ~= "number" or res.status ~= 200 then
       return false, "non 200 status code"
     end
@@ -199,78 +190,461 @@ function check_user_access(grafana_base_url, data_sources, cookie_header_value,
   return true, ""
 end
 
+LABEL_CONFLICT_POLICY_FIRST = "first"
+LABEL_CONFLICT_POLICY_MOST_RESTRICTIVE = "most_restrictive"
+LABEL_CONFLICT_POLICY_DISABLE = "disable"
+
+-- cache config used when the caching is disabled by the label conflict policy
+LABEL_CONFLICT_DISABLED_CACHE_CONFIG = { enabled = false, id = "label-conflict" }
+
+--- returns true if the cache config `a` is more restrictive than `b`,
+--- a disabled config is the most restrictive, then the smallest deltas
+---@param a CacheConfig
+---@param b CacheConfig
+---@return boolean
+function is_more_restrictive(a, b)
+  if a.enabled ~= b.enabled then
+    return a.enabled == false
+  end
+  for _, key in ipairs({ "acceptable_time_delta_seconds", "acceptable_time_range_delta_seconds", "acceptable_max_points_delta" }) do
+    if (a[key] or 0) ~= (b[key] or 0) then
+      return (a[key] or 0) < (b[key] or 0)
+    end
+  end
+  return false
+end
+
 ---comment
 ---@param queries table
 ---@param config Config
 ---@return CacheConfig
+---@return string errorMessage malformed label comments, empty if there is none
+---@return QueriesLabels labels labels of the queries, `labels` is set to the labels used to match the cache rules
+---@return CacheRuleMatch match matched cache rule and the candidates, for the debug headers
 function get_queries_config(config, queries) 
-  local labels = get_queries_labels(queries)
-  if labels == nil then
-    return config.default
+  local queries_labels, errorMessage = merge_queries_labels(queries)
+  if queries_labels.labels == nil then
+    return config.default, errorMessage, queries_labels, { rule = "default", candidates = {} }
+  end
+  if #queries_labels.conflicts == 0 then
+    local cache_config, match = config:get_cache_config(queries_labels.labels)
+    return cache_config, errorMessage, queries_labels, match
+  end
+
+  local policy = config.label_conflict_policy or LABEL_CONFLICT_POLICY_FIRST
+  if policy == LABEL_CONFLICT_POLICY_DISABLE then
+    return LABEL_CONFLICT_DISABLED_CACHE_CONFIG, errorMessage, queries_labels,
+        { rule = "label_conflict_policy", candidates = {} }
+  end
+  if policy == LABEL_CONFLICT_POLICY_MOST_RESTRICTIVE then
+    -- every query is matched with its own labels
+    local cache_config, match = nil, nil
+    for _, labels in ipairs(queries_labels.query_labels) do
+      local query_cache_config, query_match = config:get_cache_config(labels)
+      if cache_config == nil or is_more_restrictive(query_cache_config, cache_config) then
+        cache_config, match = query_cache_config, query_match
+        queries_labels.labels = labels
+      end
+    end
+    return cache_config, errorMessage, queries_labels, match
   end
-  return config:get_cache_config(labels)
+  local cache_config, match = config:get_cache_config(queries_labels.labels)
+  return cache_config, errorMessage, queries_labels, match
 end
 
+-- query text of the datasources, the first non empty key is used
 POSSIBLE_QUERY_KEYS = {
-  "expr", -- prometheus 
-  "rawSql", -- sql
-  "query", -- influx, mongodb
+  "expr", -- prometheus, loki
+  "rawSql", -- sql, clickhouse
+  "query", -- influx (influxql, flux), mongodb, elasticsearch/opensearch (lucene), tempo (traceql)
+  "expression", -- cloudwatch
+  "target", -- graphite
 }
+
+-- comments containing the labels, e.g. `#` for promql/logql, `--` for sql, `//` for flux/traceql
+LINE_COMMENT_SEQUENCES = { "--", "//", "#" }
+BLOCK_COMMENT_START = "/*"
+BLOCK_COMMENT_END = "*/"
+
+--- returns the key of the query text in the datasource query, e.g. `expr`
+---@param query table
+---@return string|nil
+function get_query_text_key(query)
+  if type(query) ~= "table" then
+    return nil
+  end
+  for _, key in ipairs(POSSIBLE_QUERY_KEYS) do
+    if type(query[key]) == "string" and string.len(query[key]) > 0 then
+      return key
+    end
+  end
+  return nil
+end
+
+--- returns the query text of the datasource query
+---@param query table
+---@return string|nil
+function get_query_text(query)
+  local key = get_query_text_key(query)
+  if key == nil then
+    return nil
+  end
+  return query[key]
+end
+
+--- removes the leading label comments from the query text of the queries, other comments are kept
+---@param queries table
+---@return number count number of modified queries
+function strip_queries_label_comments(queries)
+  local count = 0
+  for _, query in ipairs(queries) do
+    local key = get_query_text_key(query)
+    if key ~= nil then
+      local stripped = strip_label_comments(query[key])
+      if stripped ~= query[key] then
+        query[key] = stripped
+        count = count + 1
+      end
+    end
+  end
+  return count
+end
+
+---@class QueriesLabels
+---@field labels table|nil labels of all the queries, the first value of a key is used. `nil` if no label found
+---@field query_labels table[] labels of every query with labels, in the query order
+---@field conflicts string[] sorted keys with different values in the queries
+
+--- merges the labels of all the queries
+---@param queries table
+---@return QueriesLabels
+---@return string errorMessage malformed label comments of the queries, empty if there is none
+function merge_queries_labels(queries)
+  local result = { labels = nil, query_labels = {}, conflicts = {} }
+  local conflicts = {}
+  local errors = {}
+  for _, query in ipairs(queries) do
+    local raw_query = get_query_text(query)
+    if raw_query ~= nil then
+      local labels, errorMessage = get_query_labels(raw_query)
+      if errorMessage ~= "" then
+        table.insert(errors, errorMessage)
+      end
+      if labels ~= nil then
+        table.insert(result.query_labels, labels)
+        result.labels = result.labels or {}
+        for key, value in pairs(labels) do
+          if result.labels[key] == nil then
+            result.labels[key] = value
+          elseif result.labels[key] ~= value and not conflicts[key] then
+            conflicts[key] = true
+            table.insert(result.conflicts, key)
+          end
+        end
+      end
+    end
+  end
+  table.sort(result.conflicts)
+  return result, table.concat(errors, ", ")
+end
+
 ---comment
 ---@param queries table
 ---@return table|nil labels returns `nil` if no label found
+---@return string errorMessage malformed label comments of the queries, empty if there is none
 function get_queries_labels(queries)
-  local raw_query = ""
-  ---@type nil|table
-  local labels = nil
-  for _, query in pairs(queries) do
-    for _, key in pairs(POSSIBLE_QUERY_KEYS) do
-      if type(query[key]) == "string" and string.len(query[key]) > 0 then
-        raw_query = query[key]
-        break
+  local queries_labels, errorMessage = merge_queries_labels(queries)
+  return queries_labels.labels, errorMessage
+end
+
+--- formats the labels for the debug headers, e.g. `datasource=prometheus; owner="jane doe";`
+---@param labels table|nil
+---@return string
+function format_labels(labels)
+  if labels == nil then
+    return ""
+  end
+  local keys = {}
+  for key, _ in pairs(labels) do
+    table.insert(keys, key)
+  end
+  table.sort(keys)
+  local formatted = {}
+  for _, key in ipairs(keys) do
+    local value = labels[key]
+    if not value:match("^" .. LABEL_VALUE_PATTERN .. "$") then
+      value = '"' .. value:gsub('[\\"\n\t]', { ["\\"] = "\\\\", ['"'] = '\\"', ["\n"] = "\\n", ["\t"] = "\\t" }) .. '"'
+    end
+    table.insert(formatted, key .. "=" .. value .. ";")
+  end
+  return table.concat(formatted, " ")
+end
+
+---@class CommentSpan
+---@field text string text of the comment without the comment sequences
+---@field start number position of the comment sequence
+---@field finish number position after the comment, after the newline for the line comments
+
+--- returns the comments at the start of the query.
+--- line comments (`--`, `//`, `#`) and block comments (`/* */`) can be mixed
+---@param query string
+---@return CommentSpan[]
+function get_leading_comment_spans(query)
+  local comments = {}
+  local position = 1
+  while position <= query:len() do
+    local comment_start = query:find("%S", position)
+    if comment_start == nil then
+      break
+    end
+    local comment = nil
+    if query:sub(comment_start, comment_start + BLOCK_COMMENT_START:len() - 1) == BLOCK_COMMENT_START then
+      local content_start = comment_start + BLOCK_COMMENT_START:len()
+      local comment_end = query:find(BLOCK_COMMENT_END, content_start, true)
+      if comment_end == nil then
+        comment = query:sub(content_start)
+        position = query:len() + 1
+      else
+        comment = query:sub(content_start, comment_end - 1)
+        position = comment_end + BLOCK_COMMENT_END:len()
+      end
+    else
+      for _, sequence in ipairs(LINE_COMMENT_SEQUENCES) do
+        if query:sub(comment_start, comment_start + sequence:len() - 1) == sequence then
+          local line_end = query:find("\n", comment_start, true) or (query:len() + 1)
+          comment = query:sub(comment_start + sequence:len(), line_end - 1)
+          position = line_end + 1
+          break
+        end
       end
     end
-    if raw_query:len() > 0 then
-      labels = get_query_labels(raw_query)
+    if comment == nil then
+      break
     end
-    if labels ~= nil then
-      return labels
+    table.insert(comments, { text = comment, start = comment_start, finish = position })
+  end
+  return comments
+end
+
+--- returns the text of the comments at the start of the query, without the comment sequences.
+--- line comments (`--`, `//`, `#`) and block comments (`/* */`) can be mixed
+---@param query string
+---@return string[]
+function get_leading_comments(query)
+  local comments = {}
+  for _, span in ipairs(get_leading_comment_spans(query)) do
+    table.insert(comments, span.text)
+  end
+  return comments
+end
+
+--- removes the leading comments containing labels (see is_label_comment) from the query text,
+--- the whitespace after a block comment is removed up to the end of the line
+---@param query string
+---@return string
+function strip_label_comments(query)
+  local parts = {}
+  local position = 1
+  for _, span in ipairs(get_leading_comment_spans(query)) do
+    if is_label_comment(span.text) then
+      table.insert(parts, query:sub(position, span.start - 1))
+      position = span.finish
+      if query:sub(span.start, span.start + BLOCK_COMMENT_START:len() - 1) == BLOCK_COMMENT_START then
+        local _, line_end = query:find("^[ \t]*\r?\n?", position)
+        position = line_end + 1
+      end
+    end
+  end
+  table.insert(parts, query:sub(position))
+  return table.concat(parts)
+end
+
+-- bare label keys and values, the bytes above 127 allow utf-8 encoded characters
+LABEL_KEY_PATTERN = "[%w_%.%-\128-\255]+"
+LABEL_VALUE_PATTERN = "[%w_%.%-/:\128-\255]+"
+-- escape sequences of the quoted label values
+LABEL_ESCAPE_SEQUENCES = {
+  ["\\"] = "\\",
+  ['"'] = '"',
+  ["'"] = "'",
+  ["n"] = "\n",
+  ["t"] = "\t",
+}
+
+--- returns true if the comment starts with `key=`, other comments are not parsed
+---@param comment string
+---@return boolean
+function is_label_comment(comment)
+  return comment:match("^%s*" .. LABEL_KEY_PATTERN .. "%s*=") ~= nil
+end
+
+--- @param text string
+--- @param position number position of the opening quote
+--- @return string|nil value
+--- @return number position position after the closing quote
+--- @return string errorMessage
+local function parse_quoted_label_value(text, position)
+  local quote = text:sub(position, position)
+  local value = {}
+  local index = position + 1
+  while index <= text:len() do
+    local char = text:sub(index, index)
+    if char == "\\" then
+      local escaped = LABEL_ESCAPE_SEQUENCES[text:sub(index + 1, index + 1)]
+      if escaped == nil then
+        return nil, index, string.format("invalid escape sequence at position %d", index)
+      end
+      table.insert(value, escaped)
+      index = index + 2
+    elseif char == quote then
+      return table.concat(value), index + 1, ""
+    else
+      table.insert(value, char)
+      index = index + 1
+    end
+  end
+  return nil, index, string.format("unterminated quoted value starting at position %d", position)
+end
+
+--- parses the `key=value;` labels of a comment.
+--- values are bare (letters, digits, utf-8 characters, `_`, `.`, `-`, `/`, `:`) or quoted with `"` or `'`,
+--- quoted values support the \\ \" \' \n and \t escape sequences. e.g. `team=data.platform; owner="jane doe";`
+---@param text string
+---@return table<string, string> labels labels parsed before the error, the first value of a key is used
+---@return string errorMessage empty if the comment is valid
+function parse_labels(text)
+  local labels = {}
+  local position = 1
+  local skip_spaces = function(from)
+    return text:find("%S", from) or (text:len() + 1)
+  end
+  while true do
+    position = skip_spaces(position)
+    if position > text:len() then
+      return labels, ""
+    end
+    local key = text:match("^" .. LABEL_KEY_PATTERN, position)
+    if key == nil then
+      return labels, string.format("expected a label key at position %d", position)
+    end
+    position = skip_spaces(position + key:len())
+    if text:sub(position, position) ~= "=" then
+      return labels, string.format("expected = after %s at position %d", key, position)
+    end
+    position = skip_spaces(position + 1)
+
+    local value = nil
+    local quote = text:sub(position, position)
+    if quote == '"' or quote == "'" then
+      local errorMessage
+      value, position, errorMessage = parse_quoted_label_value(text, position)
+      if value == nil then
+        return labels, errorMessage
+      end
+    else
+      value = text:match("^" .. LABEL_VALUE_PATTERN, position)
+      if value == nil then
+        return labels, string.format("expected the value of %s at position %d", key, position)
+      end
+      position = position + value:len()
+    end
+
+    position = skip_spaces(position)
+    if text:sub(position, position) ~= ";" then
+      return labels, string.format("expected ; after the value of %s at position %d", key, position)
+    end
+    position = position + 1
+    if labels[key] == nil then
+      labels[key] = value
     end
   end
-  return nil
 end
 
 ---comment
 ---@param query string
 ---@return table|nil labels returns `nil` if no label found
+---@return string errorMessage malformed label comments, empty if there is none
 function get_query_labels(query)
-  local _, comment_sequence_end = query:find("^[^a-zA-Z0-9 \t]+")
-  if comment_sequence_end == nil then
-    return nil
+  local labels = {}
+  local label_count = 0
+  local errors = {}
+  -- labels can be split over several leading comments, the first value of a key is used
+  for _, comment in ipairs(get_leading_comments(query)) do
+    if is_label_comment(comment) then
+      local comment_labels, errorMessage = parse_labels(comment)
+      if errorMessage ~= "" then
+        table.insert(errors, string.format("malformed label comment \"%s\": %s", comment:match("^%s*(.-)%s*$"), errorMessage))
+      end
+      for key, value in pairs(comment_labels) do
+        if labels[key] == nil then
+          labels[key] = value
+          label_count = label_count + 1
+        end
+      end
+    end
   end
+  if label_count == 0 then
+    return nil, table.concat(errors, ", ")
+  end
+  return labels, table.concat(errors, ", ")
+end
 
-  local line_end, _ = query:find("\n")
-  line_end = line_end or query:len()
-  local label_string = query:sub(comment_sequence_end + 1, line_end - 1)
+--- get_response_format returns the response format requested by the client using the Accept header
+--- @param accept_header string|table|nil
+--- @return string format `arrow` or `json`
+function get_response_format(accept_header)
+  if type(accept_header) == "table" then
+    accept_header = table.concat(accept_header, ",")
+  end
+  if type(accept_header) == "string" and accept_header:find("application/vnd%.apache%.arrow") ~= nil then
+    return "arrow"
+  end
+  return "json"
+end
 
-  local labels = {}
-  local label_pattern = "%s*[a-zA-Z0-9][a-zA-Z0-9-]+%s*=%s*[a-zA-Z0-9-]+%s*;"
+FALSY_BYPASS_VALUES = {
+  ["0"] = true,
+  ["false"] = true,
+  ["no"] = true,
+  ["off"] = true,
+}
 
-  local label_count = 0
-  for label in string.gmatch(label_string, label_pattern) do
-    label = label:gsub("[%s;]", "")
-    local equal_char_index = string.find(label, "=")
-    if equal_char_index ~= nil then
-      local key = label:sub(0, equal_char_index - 1)
-      local value = label:sub(equal_char_index + 1, label:len())
-      labels[key] = value
-      label_count = label_count + 1
+--- returns true if the header/query param value asks for a cache bypass
+--- @param value any
+--- @return boolean
+local function is_bypass_value(value)
+  if type(value) == "table" then
+    value = value[1]
+  end
+  if value == true then
+    -- query param without value e.g. `?nocache`
+    return true
+  end
+  if type(value) ~= "string" or string.len(value) == 0 then
+    return false
+  end
+  return FALSY_BYPASS_VALUES[string.lower(value)] ~= true
+end
+
+--- get_cache_bypass_reason returns the reason if the request asks to skip the cached response
+--- format = header:<header name> or query:<param name>
+--- @param headers table request headers with lower case keys
+--- @param query_args table
+--- @param bypass_headers table list of header names
+--- @param bypass_query_params table list of query param names
+--- @return string|nil reason returns `nil` if the request should not bypass the cache
+function get_cache_bypass_reason(headers, query_args, bypass_headers, bypass_query_params)
+  for _, header in pairs(bypass_headers) do
+    if is_bypass_value(headers[string.lower(header)]) then
+      return "header:" .. header
     end
   end
-  if label_count == 0 then
-    return nil
+  for _, param in pairs(bypass_query_params) do
+    if is_bypass_value(query_args[param]) then
+      return "query:" .. param
+    end
   end
-  return labels
+  return nil
 end
 
 return {
@@ -281,6 +655,17 @@ return {
   get_datasource_uids = get_datasource_uids,
   get_grafana_query_cache_key = get_grafana_query_cache_key,
   get_queries_config = get_queries_config,
+  get_query_text = get_query_text,
+  get_leading_comments = get_leading_comments,
+  is_label_comment = is_label_comment,
+  parse_labels = parse_labels,
   get_query_labels = get_query_labels,
-  get_queries_labels = get_queries_labels
+  strip_label_comments = strip_label_comments,
+  strip_queries_label_comments = strip_queries_label_comments,
+  merge_queries_labels = merge_queries_labels,
+  get_queries_labels = get_queries_labels,
+  format_labels = format_labels,
+  is_more_restrictive = is_more_restrictive,
+  get_cache_bypass_reason = get_cache_bypass_reason,
+  get_response_format = get_response_format
 }
@@ -0,0 +1,169 @@
+-- routing of the requests to multiple grafana upstreams (GRAFANA_UPSTREAMS_FILE).
+-- the upstream is selected by the Host header, every upstream has its own cache rules, cache key namespace
+-- and grafana base url used for the access checks. requests not matching any upstream use GRAFANA_HOST.
+local lyaml = require "lyaml"
+local utils = require "utils"
+local config = require "config"
+local grafana_client = require "grafana_client"
+
+-- nginx upstream block of GRAFANA_HOST
+DEFAULT_GRAFANA_UPSTREAM = "grafana_server"
+
+---@class GrafanaUpstream
+---@field name string cache key namespace
+---@field server_names string[] exact host names or wildcards starting with `*.`
+---@field grafana_host string host:port of grafana
+---@field grafana_scheme? string http or https, default GRAFANA_SCHEME
+---@field cache_rules_file? string default CACHE_RULES_FILE_PATH
+
+---@type GrafanaUpstream[]
+local upstreams = {}
+
+--- @param upstream table
+--- @return boolean valid
+--- @return string errorMessage
+function validate_upstream(upstream)
+    if type(upstream) ~= "table" then
+        return false, string.format("expected table got %s", type(upstream))
+    end
+    local valid, message = utils.check_table_type(upstream, {
+        { key = "name",             type = "string" },
+        { key = "server_names",     type = "table" },
+        { key = "grafana_host",     type = "string" },
+        { key = "grafana_scheme",   type = "string", required = false },
+        { key = "cache_rules_file", type = "string", required = false },
+    })
+    if valid == false then
+        return false, message
+    end
+    -- the name is part of the cache key
+    if not upstream.name:match("^[%w_%-]+$") then
+        return false, "name should only contain letters, digits, _ and -"
+    end
+    if #upstream.server_names == 0 then
+        return false, "server_names should not be empty"
+    end
+    for _, server_name in ipairs(upstream.server_names) do
+        if type(server_name) ~= "string" or string.len(server_name) == 0 then
+            return false, "server_names should be a list of host names"
+        end
+    end
+    if not upstream.grafana_host:match("^[%w%.%-]+:?%d*$") and not upstream.grafana_host:match("^%[[%x:]+%]:?%d*$") then
+        return false, "invalid grafana_host " .. upstream.grafana_host .. ", expected host[:port]"
+    end
+    if upstream.grafana_scheme ~= nil and upstream.grafana_scheme ~= "http" and upstream.grafana_scheme ~= "https" then
+        return false, "invalid grafana_scheme " .. upstream.grafana_scheme .. ", valid values are: http and https"
+    end
+    return true, ""
+end
+
+--- @param data string yaml
+--- @return GrafanaUpstream[]|nil upstreams
+--- @return string errorMessage
+function parse_and_validate_upstreams(data)
+    local ok, parsed = pcall(lyaml.load, data)
+    if not ok or type(parsed) ~= "table" or type(parsed.upstreams) ~= "table" then
+        return nil, "expected a list of upstreams in the upstreams key"
+    end
+    local names = {}
+    local server_names = {}
+    for index, upstream in ipairs(parsed.upstreams) do
+        local valid, message = validate_upstream(upstream)
+        if valid == false then
+            return nil, string.format("%d[st/nd/th] upstream invalid. message: %s", index, message)
+        end
+        if names[upstream.name] then
+            return nil, "duplicate upstream name " .. upstream.name
+        end
+        names[upstream.name] = true
+        for _, server_name in ipairs(upstream.server_names) do
+            server_name = server_name:lower()
+            if server_names[server_name] then
+                return nil, "duplicate server name " .. server_name
+            end
+            server_names[server_name] = true
+        end
+    end
+    return parsed.upstreams, ""
+end
+
+--- returns the upstream of the host, exact server names take precedence over the wildcards
+--- @param configured_upstreams GrafanaUpstream[]
+--- @param host string|nil $host, lowercase without port
+--- @return GrafanaUpstream|nil
+function get_upstream_for_host(configured_upstreams, host)
+    if type(host) ~= "string" then
+        return nil
+    end
+    host = host:lower()
+    local wildcard_match = nil
+    local wildcard_length = 0
+    for _, upstream in ipairs(configured_upstreams) do
+        for _, server_name in ipairs(upstream.server_names) do
+            server_name = server_name:lower()
+            if server_name == host then
+                return upstream
+            end
+            local suffix = server_name:match("^%*(%..+)$")
+            -- the longest wildcard wins like in nginx server_name
+            if suffix ~= nil and string.len(suffix) > wildcard_length and
+                string.len(host) > string.len(suffix) and host:sub(-string.len(suffix)) == suffix then
+                wildcard_match = upstream
+                wildcard_length = string.len(suffix)
+            end
+        end
+    end
+    return wildcard_match
+end
+
+--- loads the upstreams and their cache rules, called in init_by_lua after config.load_config.
+--- empty file path disables the routing
+--- @param file_path string GRAFANA_UPSTREAMS_FILE
+--- @param default_cache_rules_file string CACHE_RULES_FILE_PATH
+local function init(file_path, default_cache_rules_file)
+    upstreams = {}
+    if type(file_path) ~= "string" or string.len(file_path) == 0 then
+        return
+    end
+    local file, err_msg = io.open(file_path, "rb")
+    if file == nil then
+        error("unable to open grafana upstreams file, ERR: " .. err_msg)
+    end
+    local data = file:read("a")
+    io.close(file)
+    local result, errorMessage = parse_and_validate_upstreams(data)
+    if result == nil then
+        error("invalid grafana upstreams file " .. file_path .. ": " .. errorMessage)
+    end
+    for _, upstream in ipairs(result) do
+        local loadErrorMessage = config.load_config(upstream.cache_rules_file or default_cache_rules_file, upstream.name)
+        if loadErrorMessage ~= nil then
+            error(string.format("upstream %s: %s", upstream.name, loadErrorMessage))
+        end
+    end
+    upstreams = result
+end
+
+--- set_by_lua handler of the server, sets $grafana_host, $grafana_scheme, $grafana_tls_server_name and $grafana_upstream_name
+--- @return string upstream proxy_pass target, the grafana_server upstream block or the host of the routed upstream
+local function route()
+    local upstream = get_upstream_for_host(upstreams, ngx.var.host)
+    if upstream == nil then
+        return DEFAULT_GRAFANA_UPSTREAM
+    end
+    ngx.var.grafana_upstream_name = upstream.name
+    ngx.var.grafana_host = upstream.grafana_host
+    ngx.var.grafana_tls_server_name = grafana_client.parse_peer_address(upstream.grafana_host, upstream.grafana_scheme)
+    if upstream.grafana_scheme ~= nil then
+        ngx.var.grafana_scheme = upstream.grafana_scheme
+    end
+    return upstream.grafana_host
+end
+
+return {
+    validate_upstream = validate_upstream,
+    parse_and_validate_upstreams = parse_and_validate_upstreams,
+    get_upstream_for_host = get_upstream_for_host,
+    init = init,
+    route = route,
+}
@@ -0,0 +1,94 @@
+-- metrics are stored in the shared dict so all the nginx workers update the same counters
+METRICS_KEY_PREFIX = "metrics:"
+METRICS_NAME_PREFIX = "grafana_query_cache_"
+
+---@class Metric
+---@field name string
+---@field type string counter|gauge
+---@field help string
+
+---@type table<number, Metric>
+METRICS = {
+    {
+        name = "compression_uncompressed_bytes_total",
+        type = "counter",
+        help = "Size of the query responses before compression."
+    },
+    {
+        name = "compression_compressed_bytes_total",
+        type = "counter",
+        help = "Size of the query responses after compression."
+    },
+    {
+        name = "compression_ratio",
+        type = "gauge",
+        help = "Ratio of uncompressed to compressed query response size."
+    },
+}
+
+--- increments the counter by value
+--- @param name string
+--- @param value number
+function increment(name, value)
+    local _, err = ngx.shared.shared:incr(METRICS_KEY_PREFIX .. name, value, 0)
+    if err ~= nil then
+        ngx.log(ngx.STDERR, "failed to increment metric ", name, ": ", err)
+    end
+end
+
+--- records the response size before and after compression, called from the compression server log phase
+--- @param uncompressed_bytes number|nil
+--- @param compressed_bytes number|nil
+function observe_compression(uncompressed_bytes, compressed_bytes)
+    if uncompressed_bytes == nil or compressed_bytes == nil or compressed_bytes == 0 then
+        return
+    end
+    increment("compression_uncompressed_bytes_total", uncompressed_bytes)
+    increment("compression_compressed_bytes_total", compressed_bytes)
+end
+
+--- returns the metric values, derived metrics (e.g. compression_ratio) are calculated from the counters
+--- @param get_value function returns the stored value for the metric name
+--- @return table<string, number>
+function get_metric_values(get_value)
+    local values = {}
+    for _, metric in pairs(METRICS) do
+        values[metric.name] = tonumber(get_value(metric.name)) or 0
+    end
+    if values["compression_compressed_bytes_total"] > 0 then
+        values["compression_ratio"] = values["compression_uncompressed_bytes_total"] /
+            values["compression_compressed_bytes_total"]
+    end
+    return values
+end
+
+--- returns the metrics in prometheus text format
+--- @param values table<string, number>
+--- @return string
+function format_metrics(values)
+    local output = ""
+    for _, metric in pairs(METRICS) do
+        local name = METRICS_NAME_PREFIX .. metric.name
+        output = output .. string.format("# HELP %s %s\n", name, metric.help)
+        output = output .. string.format("# TYPE %s %s\n", name, metric.type)
+        output = output .. string.format("%s %s\n", name, tostring(values[metric.name] or 0))
+    end
+    return output
+end
+
+--- content handler of the metrics endpoint
+function serve_metrics()
+    local values = get_metric_values(function(name)
+        return ngx.shared.shared:get(METRICS_KEY_PREFIX .. name)
+    end)
+    ngx.header["Content-Type"] = "text/plain; version=0.0.4"
+    ngx.print(format_metrics(values))
+end
+
+return {
+    increment = increment,
+    observe_compression = observe_compression,
+    get_metric_values = get_metric_values,
+    format_metrics = format_metrics,
+    serve_metrics = serve_metrics
+}
@@ -0,0 +1,254 @@
+local json = require "cjson";
+local utils = require "utils"
+local cache_file = require "cache_file"
+local arrow = require "arrow"
+
+NOT_STORED_REASON_QUERY_ERROR = "query_error"
+NOT_STORED_REASON_SIZE_LIMIT = "response_size_limit"
+
+-- only these responses come from the upstream and can end up in the cache
+STORABLE_CACHE_STATUSES = {
+    MISS = true,
+    EXPIRED = true,
+    BYPASS = true,
+}
+
+-- previous reason is kept for the debug header of the next request with the same cache key
+NOT_STORED_REASON_TTL_SECONDS = 600
+
+--- get_result_frames_error returns the first error notice of the result data frames.
+--- frames are json encoded (`frames`) or base64 arrow encoded (`dataframes`, older grafana versions)
+--- @param result table
+--- @return string|nil errorMessage
+local function get_result_frames_error(result)
+    if type(result.frames) == "table" then
+        for _, frame in pairs(result.frames) do
+            if type(frame) == "table" and type(frame.schema) == "table" then
+                local frame_error = arrow.get_frame_error(frame.schema.meta)
+                if frame_error ~= nil then
+                    return frame_error
+                end
+            end
+        end
+    end
+    if type(result.dataframes) == "table" then
+        for _, encoded_frame in pairs(result.dataframes) do
+            if type(encoded_frame) == "string" then
+                local frame_error = arrow.get_arrow_frame_error(ngx.decode_base64(encoded_frame))
+                if frame_error ~= nil then
+                    return frame_error
+                end
+            end
+        end
+    end
+    return nil
+end
+
+--- get_response_error returns the first query error found in the grafana query response
+--- grafana returns 200 status code even if some of the queries failed, the error is set in results[refId].error
+--- @param parsed_response table
+--- @return string|nil errorMessage returns `nil` if none of the queries failed
+function get_response_error(parsed_response)
+    if type(parsed_response) ~= "table" or type(parsed_response.results) ~= "table" then
+        return nil
+    end
+    for ref_id, result in pairs(parsed_response.results) do
+        if type(result) == "table" then
+            if type(result.error) == "string" and string.len(result.error) > 0 then
+                return string.format("refId=%s: %s", tostring(ref_id), result.error)
+            end
+            if type(result.status) == "number" and result.status >= 400 then
+                return string.format("refId=%s: status %d", tostring(ref_id), result.status)
+            end
+            local frame_error = get_result_frames_error(result)
+            if frame_error ~= nil then
+                return string.format("refId=%s: %s", tostring(ref_id), frame_error)
+            end
+        end
+    end
+    return nil
+end
+
+--- get_not_stored_reason returns the reason if the response body should not be stored in the cache
+--- @param body string
+--- @param max_size number|nil
+--- @param cache_errors boolean
+--- @param content_type string|nil
+--- @return string|nil reason returns `nil` if the response can be cached
+function get_not_stored_reason(body, max_size, cache_errors, content_type)
+    if max_size ~= nil and string.len(body) > max_size then
+        return NOT_STORED_REASON_SIZE_LIMIT
+    end
+    if cache_errors == true then
+        return nil
+    end
+    if arrow.is_arrow(content_type, body) then
+        if arrow.get_arrow_frame_error(body) ~= nil then
+            return NOT_STORED_REASON_QUERY_ERROR
+        end
+        return nil
+    end
+    local ok, parsed_response = pcall(json.decode, body)
+    if not ok then
+        -- unknown response format, nothing to inspect
+        return nil
+    end
+    if get_response_error(parsed_response) ~= nil then
+        return NOT_STORED_REASON_QUERY_ERROR
+    end
+    return nil
+end
+
+--- @return boolean
+local function should_inspect_response()
+    if ngx.var.cache_key == nil or string.len(ngx.var.cache_key) == 0 then
+        return false
+    end
+    if ngx.status ~= ngx.HTTP_OK then
+        return false
+    end
+    return STORABLE_CACHE_STATUSES[ngx.var.upstream_cache_status] == true
+end
+
+--- @param cache_key string
+--- @return string
+local function not_stored_reason_key(cache_key)
+    return "not_stored_reason:" .. cache_key
+end
+
+--- returns the reason the previous response with the same cache key was not stored,
+--- `nil` if it was stored or if it had no query error and was not too large
+--- @param cache_key string
+--- @return string|nil
+function get_previous_not_stored_reason(cache_key)
+    if cache_key == nil or string.len(cache_key) == 0 then
+        return nil
+    end
+    return ngx.shared.shared:get(not_stored_reason_key(cache_key))
+end
+
+--- @param request_id string
+--- @return string
+local function compression_server_reason_key(request_id)
+    return "not_stored_reason_request:" .. request_id
+end
+
+-- with compression enabled the proxy receives the gzip compressed body,
+-- so the body is inspected by the compression server before it is compressed
+--- @return boolean
+local function is_compression_enabled()
+    return ngx.var.cache_compression ~= nil and ngx.var.cache_compression ~= "off"
+end
+
+--- header_filter sets cache_not_stored_reason variable used by the debug headers.
+--- query errors are only known once the whole body is read, so the reason recorded for the previous response
+--- with the same cache key is used unless the content length is already above the limit.
+local function header_filter()
+    ngx.ctx.inspect_response = should_inspect_response()
+    ngx.ctx.inspect_body = ngx.ctx.inspect_response and not is_compression_enabled()
+    ngx.ctx.response_content_type = ngx.header["Content-Type"]
+    if ngx.var.cache_key == nil or string.len(ngx.var.cache_key) == 0 then
+        return
+    end
+    local max_size = utils.parse_size(ngx.var.max_cacheable_response_size)
+    local content_length = tonumber(ngx.header["Content-Length"])
+    if ngx.ctx.inspect_response and max_size ~= nil and content_length ~= nil and content_length > max_size then
+        ngx.ctx.not_stored_reason = NOT_STORED_REASON_SIZE_LIMIT
+        ngx.var.cache_not_stored_reason = NOT_STORED_REASON_SIZE_LIMIT
+        return
+    end
+    local previous_reason = get_previous_not_stored_reason(ngx.var.cache_key)
+    if previous_reason ~= nil then
+        ngx.var.cache_not_stored_reason = previous_reason
+    end
+end
+
+--- body_filter buffers the response body (up to the max cacheable size) and checks it once the last chunk is received
+local function body_filter()
+    if not ngx.ctx.inspect_body or ngx.ctx.not_stored_reason ~= nil then
+        return
+    end
+    local max_size = utils.parse_size(ngx.var.max_cacheable_response_size)
+    local chunk, eof = ngx.arg[1], ngx.arg[2]
+
+    local chunks = ngx.ctx.response_chunks or {}
+    ngx.ctx.response_chunks = chunks
+    ngx.ctx.response_size = (ngx.ctx.response_size or 0) + string.len(chunk)
+    if max_size ~= nil and ngx.ctx.response_size > max_size then
+        ngx.ctx.not_stored_reason = NOT_STORED_REASON_SIZE_LIMIT
+        ngx.ctx.response_chunks = nil
+        return
+    end
+    table.insert(chunks, chunk)
+    if not eof then
+        return
+    end
+
+    ngx.ctx.not_stored_reason = get_not_stored_reason(
+        table.concat(chunks),
+        max_size,
+        ngx.var.cache_responses_with_errors == "true",
+        ngx.ctx.response_content_type
+    )
+    ngx.ctx.response_chunks = nil
+end
+
+--- log removes the stored response if it was not supposed to be cached.
+--- proxy_no_cache is evaluated before the body is received, so the cache file is deleted after nginx stores it,
+--- the next requests with the same cache key are not stored (see set_cache_key.lua).
+local function log()
+    if ngx.var.cache_key == nil or string.len(ngx.var.cache_key) == 0 then
+        return
+    end
+    local reason = ngx.ctx.not_stored_reason
+    if reason == nil and ngx.ctx.inspect_response and is_compression_enabled() then
+        local request_key = compression_server_reason_key(ngx.var.request_id)
+        reason = ngx.shared.shared:get(request_key)
+        ngx.shared.shared:delete(request_key)
+        ngx.ctx.not_stored_reason = reason
+    end
+    if reason == nil then
+        if ngx.ctx.inspect_response then
+            ngx.shared.shared:delete(not_stored_reason_key(ngx.var.cache_key))
+        end
+        return
+    end
+    ngx.var.cache_not_stored_reason = reason
+    ngx.shared.shared:set(not_stored_reason_key(ngx.var.cache_key), reason, NOT_STORED_REASON_TTL_SECONDS)
+
+    local deleted, errorMessage = cache_file.delete_cache_file(ngx.var.cache_directory, ngx.var.cache_key)
+    if deleted then
+        ngx.log(ngx.INFO, "removed cached response, reason: ", reason)
+    elseif cache_file.cache_file_exists(ngx.var.cache_directory, ngx.var.cache_key) then
+        -- served until it expires
+        ngx.log(ngx.ERR, "failed to remove cached response, reason: ", reason, " ", errorMessage)
+    else
+        -- the file will not exist if proxy_cache_min_uses is not reached yet or the response was not stored (proxy_no_cache)
+        ngx.log(ngx.DEBUG, "cached response not removed, reason: ", reason, " ", errorMessage)
+    end
+end
+
+--- header filter of the compression server, the body is inspected only for requests forwarded by the cache location
+local function compression_server_header_filter()
+    ngx.ctx.inspect_body = ngx.status == ngx.HTTP_OK and ngx.var.http_x_grafana_query_cache_request_id ~= nil
+    ngx.ctx.response_content_type = ngx.header["Content-Type"]
+end
+
+--- log handler of the compression server, shares the inspection result with the cache location using the request id
+local function compression_server_log()
+    local request_id = ngx.var.http_x_grafana_query_cache_request_id
+    if request_id ~= nil and ngx.ctx.not_stored_reason ~= nil then
+        ngx.shared.shared:set(compression_server_reason_key(request_id), ngx.ctx.not_stored_reason, 60)
+    end
+end
+
+return {
+    header_filter = header_filter,
+    compression_server_header_filter = compression_server_header_filter,
+    compression_server_log = compression_server_log,
+    body_filter = body_filter,
+    log = log,
+    get_response_error = get_response_error,
+    get_previous_not_stored_reason = get_previous_not_stored_reason,
+    get_not_stored_reason = get_not_stored_reason
+}
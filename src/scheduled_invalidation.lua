@@ -0,0 +1,162 @@
+-- scheduled invalidation (invalidate_at in cache_rules.yaml).
+-- the generation of the matching cache rule (or the global cache key prefix) is set to the scheduled time,
+-- so all the replicas end up with the same generation without coordination and missed runs are applied on startup.
+local cron = require "cron"
+local update_cache_key_prefix = require "update_cache_key_prefix"
+
+SCHEDULED_INVALIDATION_CHECK_INTERVAL_SECONDS = 15
+-- runs missed while nginx was down are only looked up within this window
+SCHEDULED_INVALIDATION_MAX_LOOKBACK_SECONDS = 31 * 24 * 60 * 60
+
+---@class InvalidationSchedule
+---@field name string|nil generation name (see get_generation_name), `nil` for the global cache key prefix
+---@field expression string
+---@field schedule CronSchedule
+---@field last_checked number|nil
+
+---@type InvalidationSchedule[]
+local schedules = {}
+
+--- returns the name of the generation advanced by the invalidate_at of the cache config, or by the global invalidate_at
+--- if cache_config_id is `nil`. the generations of the grafana upstreams (see grafana_upstreams.lua) are namespaced
+--- by the upstream name, the global invalidate_at of the global config advances the global cache key prefix (`nil`)
+--- @param cache_config_id any
+--- @param upstream_name string|nil $grafana_upstream_name, empty for the default grafana upstream
+--- @return string|nil
+function get_generation_name(cache_config_id, upstream_name)
+    if upstream_name == nil or upstream_name == "" then
+        if cache_config_id == nil then
+            return nil
+        end
+        return tostring(cache_config_id)
+    end
+    if cache_config_id == nil then
+        return upstream_name .. ":"
+    end
+    return upstream_name .. ":" .. tostring(cache_config_id)
+end
+
+--- returns the schedules of the global invalidate_at and the cache configs with invalidate_at
+--- @param cfg Config
+--- @param upstream_name string|nil name of the grafana upstream of the config, `nil` for the global config
+--- @return InvalidationSchedule[]|nil schedules
+--- @return string errorMessage
+function get_schedules(cfg, upstream_name)
+    local result = {}
+    local add_schedule = function(name, expression)
+        local schedule, errorMessage = cron.parse_cron_expression(expression)
+        if schedule == nil then
+            return errorMessage
+        end
+        table.insert(result, { name = name, expression = expression, schedule = schedule })
+        return nil
+    end
+
+    if cfg.invalidate_at ~= nil then
+        local errorMessage = add_schedule(get_generation_name(nil, upstream_name), cfg.invalidate_at)
+        if errorMessage ~= nil then
+            return nil, "invalid global invalidate_at: " .. errorMessage
+        end
+    end
+    local cache_configs = {}
+    if type(cfg.default) == "table" then
+        table.insert(cache_configs, cfg.default)
+    end
+    for _, cache_rule in pairs(cfg.cache_rules or {}) do
+        table.insert(cache_configs, cache_rule["cache_config"])
+    end
+    for _, cache_config in ipairs(cache_configs) do
+        if cache_config.invalidate_at ~= nil then
+            local errorMessage = add_schedule(get_generation_name(cache_config.id, upstream_name), cache_config.invalidate_at)
+            if errorMessage ~= nil then
+                return nil, string.format("invalid invalidate_at of %s: %s", tostring(cache_config.id), errorMessage)
+            end
+        end
+    end
+    return result, ""
+end
+
+--- returns the scheduled time the generation should be advanced to
+--- @param schedule InvalidationSchedule
+--- @param generation number|nil current generation
+--- @param now number
+--- @return number|nil
+function get_due_run(schedule, generation, now)
+    local from = math.max(generation or 0, schedule.last_checked or 0, now - SCHEDULED_INVALIDATION_MAX_LOOKBACK_SECONDS)
+    return cron.get_latest_scheduled_run(schedule.schedule, from, now)
+end
+
+--- loads the schedules of the global config and of the grafana upstreams and the persisted generations,
+--- called in init_by_lua after update_cache_key_prefix.init
+--- @param cfg Config|nil
+--- @param upstream_configs table<string, Config>|nil configs by grafana upstream name
+local function init(cfg, upstream_configs)
+    schedules = {}
+    local configs = {}
+    if cfg ~= nil then
+        table.insert(configs, { config = cfg })
+    end
+    local upstream_names = {}
+    for upstream_name in pairs(upstream_configs or {}) do
+        table.insert(upstream_names, upstream_name)
+    end
+    table.sort(upstream_names)
+    for _, upstream_name in ipairs(upstream_names) do
+        table.insert(configs, { config = upstream_configs[upstream_name], upstream_name = upstream_name })
+    end
+    for _, entry in ipairs(configs) do
+        local result, errorMessage = get_schedules(entry.config, entry.upstream_name)
+        if result == nil then
+            if entry.upstream_name ~= nil then
+                errorMessage = string.format("upstream %s: %s", entry.upstream_name, errorMessage)
+            end
+            error(errorMessage)
+        end
+        for _, schedule in ipairs(result) do
+            table.insert(schedules, schedule)
+        end
+    end
+    for _, schedule in ipairs(schedules) do
+        if schedule.name ~= nil then
+            update_cache_key_prefix.load_generation(schedule.name)
+        end
+    end
+end
+
+local function check_schedules(premature)
+    if premature then
+        return
+    end
+    local now = ngx.time()
+    for _, schedule in ipairs(schedules) do
+        local due_run = get_due_run(schedule, update_cache_key_prefix.get_generation(schedule.name), now)
+        schedule.last_checked = now - now % 60
+        if due_run ~= nil then
+            local updated = update_cache_key_prefix.advance_generation(due_run, schedule.name)
+            if updated then
+                ngx.log(ngx.NOTICE, "scheduled invalidation \"", schedule.expression, "\" of ",
+                    schedule.name or "all the cache rules", " at ", due_run)
+            end
+        end
+    end
+end
+
+--- starts the schedule check timer, called in init_worker_by_lua
+local function start()
+    if #schedules == 0 or ngx.worker.id() ~= 0 then
+        return
+    end
+    ngx.timer.at(0, check_schedules)
+    local ok, err = ngx.timer.every(SCHEDULED_INVALIDATION_CHECK_INTERVAL_SECONDS, check_schedules)
+    if not ok then
+        ngx.log(ngx.STDERR, "failed to start scheduled invalidation: ", err)
+    end
+end
+
+return {
+    get_generation_name = get_generation_name,
+    get_schedules = get_schedules,
+    get_due_run = get_due_run,
+    init = init,
+    start = start,
+}
@@ -1,13 +1,41 @@
 local grafana_request = require "grafana_request"
 local json = require "cjson";
 local config = require "config";
+local utils = require "utils"
+local cache_index = require "cache_index"
+local update_cache_key_prefix = require "update_cache_key_prefix"
+local scheduled_invalidation = require "scheduled_invalidation"
+local tracing = require "tracing"
+local response_filter = require "response_filter"
+
+--- removes the label comments from the queries of the proxied body (STRIP_QUERY_LABELS),
+--- the cache key is generated from the original body
+--- @param body_data string
+local function strip_body_label_comments(body_data)
+    local body = utils.roundtrip_json.decode(body_data)
+    if grafana_request.strip_queries_label_comments(body.queries) > 0 then
+        ngx.req.set_body_data(utils.roundtrip_json.encode(body))
+    end
+end
+
+--- finishes the cache key span if it is still open, the span is kept in ngx.ctx so error_handler can finish it
+--- @param attributes table|nil
+--- @param error_message string|nil
+local function finish_cache_key_span(attributes, error_message)
+    local span = ngx.ctx.cache_key_span
+    ngx.ctx.cache_key_span = nil
+    tracing.finish_span(span, attributes, error_message)
+end
 
 --- set generated_cache_key and cache_access_denied nginx variables
 function set_cache_key()
-    local body_data = get_body_data()
+    ngx.ctx.cache_key_span = tracing.start_span("generate cache key")
+    local body_data = utils.get_body_data()
     if not body_data then
+        ngx.log(ngx.STDERR, "request doesn't have body, tried both body_data and body_file")
         -- no caching
         ngx.var.generated_cache_key = ""
+        finish_cache_key_span({ ["cache.enabled"] = false })
         return
     end
 
@@ -16,17 +44,42 @@ function set_cache_key()
       error("invalid request body")
     end
 
-    local cfg = config.get_config()
+    local cfg = config.get_config(ngx.var.grafana_upstream_name)
     if cfg == nil then
-        error("unable to get the global config")
+        error("unable to get the config of the grafana upstream " .. tostring(ngx.var.grafana_upstream_name))
+    end
+    local request_cache_config, labelsErrorMessage, queries_labels, rule_match = grafana_request.get_queries_config(cfg, parsed_request_body.queries)
+    if labelsErrorMessage ~= "" then
+        ngx.log(ngx.WARN, "invalid query labels, ", labelsErrorMessage)
+    end
+    if #queries_labels.conflicts ~= 0 then
+        ngx.log(ngx.INFO, "conflicting query labels: ", table.concat(queries_labels.conflicts, ","),
+            ", policy: ", cfg.label_conflict_policy)
+    end
+    -- labels are only logged with the json access log (see access_log.lua)
+    if ngx.var.access_log_format == "json" then
+        ngx.ctx.labels = queries_labels.labels
+    end
+    -- malformed label comments are removed too
+    if ngx.var.strip_query_labels == "true" and (queries_labels.labels ~= nil or labelsErrorMessage ~= "") then
+        strip_body_label_comments(body_data)
+    end
+    if ngx.var.debug == "yes" then
+        ngx.var.cache_labels = grafana_request.format_labels(queries_labels.labels)
+        ngx.var.cache_label_conflicts = table.concat(queries_labels.conflicts, ",")
+        ngx.var.cache_rule = rule_match.rule
+        ngx.var.cache_rule_candidates = table.concat(rule_match.candidates, ",")
     end
-    local request_cache_config = grafana_request.get_queries_config(cfg, parsed_request_body.queries)
     if request_cache_config.enabled == false then
+        finish_cache_key_span({ ["cache.enabled"] = false })
         return
     end
     if tostring(request_cache_config.id) ~= nil then
         ngx.var.cache_config_id = tostring(request_cache_config.id)
     end
+    if request_cache_config.inject_cache_metadata == true then
+        ngx.var.inject_cache_metadata = 1
+    end
 
     local generated_cache_key, datasource_uids, errorMessage = grafana_request.get_cache_key_and_datasource_uids(
         parsed_request_body,
@@ -40,6 +93,49 @@ function set_cache_key()
         return
     end
 
+    ngx.ctx.datasource_uids = datasource_uids
+
+    -- arrow and json encoded responses of the same queries must not share the cache entry
+    local response_format = grafana_request.get_response_format(ngx.req.get_headers()["Accept"])
+    if response_format ~= "json" then
+        generated_cache_key = generated_cache_key .. ";format=" .. response_format
+    end
+
+    -- advanced by the scheduled invalidation (invalidate_at) of the rule file of the grafana upstream,
+    -- the global invalidate_at of CACHE_RULES_FILE_PATH advances the cache key prefix
+    if cfg.invalidate_at ~= nil and ngx.var.grafana_upstream_name ~= "" then
+        local generation = update_cache_key_prefix.get_generation(
+            scheduled_invalidation.get_generation_name(nil, ngx.var.grafana_upstream_name)
+        )
+        if generation ~= nil then
+            generated_cache_key = generated_cache_key .. ";upstream_generation=" .. tostring(generation)
+        end
+    end
+
+    -- advanced by the scheduled invalidation (invalidate_at) of the cache rule
+    if request_cache_config.invalidate_at ~= nil and request_cache_config.id ~= nil then
+        local generation = update_cache_key_prefix.get_generation(
+            scheduled_invalidation.get_generation_name(request_cache_config.id, ngx.var.grafana_upstream_name)
+        )
+        if generation ~= nil then
+            generated_cache_key = generated_cache_key .. ";generation=" .. tostring(generation)
+        end
+    end
+
+    -- advanced by /cache/webhook for the datasources and the dashboard of the request (see webhook.lua)
+    local uid_generations = update_cache_key_prefix.get_uid_generations_cache_key(
+        datasource_uids,
+        ngx.req.get_headers()["X-Dashboard-Uid"]
+    )
+    if string.len(uid_generations) ~= 0 then
+        generated_cache_key = generated_cache_key .. ";uid_generations=" .. uid_generations
+    end
+
+    -- grafana upstreams (GRAFANA_UPSTREAMS_FILE) must not share the cache entries
+    if ngx.var.grafana_upstream_name ~= "" then
+        generated_cache_key = generated_cache_key .. ";upstream=" .. ngx.var.grafana_upstream_name
+    end
+
     local cookie_header = ngx.req.get_headers()["Cookie"]
 
     if not cookie_header then
@@ -50,15 +146,36 @@ function set_cache_key()
         authorization_header = ""
     end
 
+    finish_cache_key_span({ ["cache.config_id"] = ngx.var.cache_config_id })
+
+    local access_check_span = tracing.start_span("check datasource access")
+    ngx.update_time()
+    local access_check_start = ngx.now()
     local user_access, errorMessage = grafana_request.check_user_access(
-        string.format("%s://%s", ngx.var.grafana_scheme, ngx.var.grafana_host), 
         datasource_uids, 
         cookie_header,
         authorization_header
     )
+    ngx.update_time()
+    ngx.ctx.access_check_time = ngx.now() - access_check_start
+    tracing.finish_span(access_check_span, { ["cache.access_denied"] = user_access ~= true }, errorMessage)
     if user_access == true then
         ngx.var.cache_access_denied = 0
     end
+
+    local bypass_reason = grafana_request.get_cache_bypass_reason(
+        ngx.req.get_headers(),
+        ngx.req.get_uri_args(),
+        utils.split_string(ngx.var.cache_bypass_headers, ","),
+        utils.split_string(ngx.var.cache_bypass_query_params, ",")
+    )
+    if bypass_reason ~= nil then
+        -- cached response is skipped but the upstream response is still stored with the same cache key
+        ngx.var.cache_bypass = 1
+        ngx.var.cache_bypass_reason = bypass_reason
+        ngx.log(ngx.INFO, "cache bypassed, reason: ", bypass_reason)
+    end
+
     local shared_dict = ngx.shared.shared
     local cache_key_prefix = shared_dict:get("cache_prefix")
     if tostring(cache_key_prefix) == nil then
@@ -67,42 +184,33 @@ function set_cache_key()
 
     ngx.var.generated_cache_key = tostring(cache_key_prefix) .. "_" .. generated_cache_key
     ngx.log(ngx.DEBUG, "cache key: ", ngx.var.generated_cache_key)
+
+    -- the previous response with the same cache key had a query error or was too large, the response is not stored
+    -- (proxy_no_cache) instead of being stored and removed once received (see response_filter.lua)
+    local previous_not_stored_reason = response_filter.get_previous_not_stored_reason(ngx.var.cache_key)
+    if previous_not_stored_reason ~= nil then
+        ngx.var.cache_not_stored_reason = previous_not_stored_reason
+    end
+
+    cache_index.record_request(
+        ngx.shared.cache_index,
+        ngx.var.cache_key,
+        ngx.var.cache_config_id,
+        datasource_uids,
+        ngx.req.get_headers()["X-Dashboard-Uid"],
+        ngx.time(),
+        utils.parse_duration(ngx.var.max_inactive_time)
+    )
 end
 
 function error_handler(err) 
     ngx.log(ngx.STDERR, "failed to generate cache key: ", err)
+    ngx.ctx.cache_key_error = tostring(err)
+    finish_cache_key_span(nil, tostring(err))
     ngx.var.generated_cache_key = ""
     ngx.var.cache_access_denied = 1
 end
 
----@return string|nil body_data
-function get_body_data()
-    ngx.req.read_body()  
-    ---@type string|nil
-    local body_data = ngx.req.get_body_data()
-    if not body_data then
-        -- try reading body file
-        local body_file = ngx.req.get_body_file()
-        if not body_file then
-            ngx.log(ngx.STDERR, "request doesn't have body, tried both body_data and body_file")
-            return nil
-        end
-        if body_file then
-            -- we are not checking the body size before reading it into memory
-            -- we should set max request size in nginx config
-            -- todo document above somewhere
-            local file = io.open(body_file, "rb")
-            if not file then
-                ngx.log(ngx.STDERR, "unable to open request file")
-                return nil
-            end
-            body_data = file:read("*all")
-        else
-            ngx.log(ngx.STDERR, "unable to get request body")
-            return nil
-        end
-    end
-    return body_data
-end
-
+tracing.start_request()
 xpcall(set_cache_key, error_handler)
+tracing.finish_rewrite()
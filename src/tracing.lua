@@ -0,0 +1,436 @@
+-- opentelemetry tracing of the query requests (TRACING_ENABLED=true).
+-- the W3C traceparent header is propagated to grafana, the spans are exported in batches
+-- to the collector using OTLP/HTTP with json encoding.
+-- spans of a request: query request (root) > generate cache key, check datasource access > GET /api/datasources/uid,
+-- cache lookup and grafana upstream.
+local json = require "cjson";
+local utils = require "utils"
+local access_log = require "access_log"
+
+TRACEPARENT_HEADER = "traceparent"
+TRACING_SCOPE_NAME = "grafana-query-cache"
+-- https://opentelemetry.io/docs/specs/otlp/ SpanKind and StatusCode
+SPAN_KIND_INTERNAL = 1
+SPAN_KIND_SERVER = 2
+SPAN_KIND_CLIENT = 3
+SPAN_STATUS_CODE_ERROR = 2
+-- spans are dropped once the queue of the worker is full
+TRACING_MAX_QUEUE_SIZE = 2048
+TRACING_MAX_EXPORT_BATCH_SIZE = 512
+TRACING_EXPORT_TIMEOUT_MILLISECONDS = 5000
+
+---@class TracingOptions
+---@field enabled boolean
+---@field endpoint string OTLP/HTTP traces endpoint, e.g. http://otel-collector:4318/v1/traces
+---@field service_name string
+---@field sample_ratio number ratio of the traces sampled when the request doesn't have a sampled parent
+---@field export_interval string nginx style duration
+
+---@type TracingOptions
+local options = {
+    enabled = false,
+    endpoint = "",
+    service_name = TRACING_SCOPE_NAME,
+    sample_ratio = 1,
+    export_interval = "5s",
+}
+
+-- finished spans of the worker waiting for the export
+local queue = {}
+
+---@class TraceContext
+---@field trace_id string 32 hex characters
+---@field parent_span_id string|nil 16 hex characters
+---@field sampled boolean
+
+---@class Span
+---@field trace_id string
+---@field span_id string
+---@field parent_span_id string|nil
+---@field parent Span|nil
+---@field name string
+---@field kind number
+---@field start_time number seconds
+---@field end_time number|nil seconds
+---@field attributes table
+---@field error string|nil
+
+--- parses the W3C traceparent header, version-trace_id-parent_id-flags
+--- @param header string|nil
+--- @return TraceContext|nil returns `nil` if the header is missing or invalid
+function parse_traceparent(header)
+    if type(header) ~= "string" then
+        return nil
+    end
+    local version, trace_id, parent_span_id, flags = header:lower():match("^%s*(%x%x)%-(%x+)%-(%x+)%-(%x%x)")
+    if version == nil or version == "ff" or #trace_id ~= 32 or #parent_span_id ~= 16 then
+        return nil
+    end
+    if not trace_id:match("[^0]") or not parent_span_id:match("[^0]") then
+        return nil
+    end
+    return {
+        trace_id = trace_id,
+        parent_span_id = parent_span_id,
+        sampled = tonumber(flags, 16) % 2 == 1,
+    }
+end
+
+--- @param trace_id string
+--- @param span_id string
+--- @param sampled boolean
+--- @return string
+function format_traceparent(trace_id, span_id, sampled)
+    return string.format("00-%s-%s-%s", trace_id, span_id, sampled and "01" or "00")
+end
+
+--- converts the ngx.now() time (milliseconds precision) to the OTLP unix nano string, numbers would lose the precision
+--- @param seconds number
+--- @return string
+function to_unix_nano(seconds)
+    return string.format("%d000000", math.floor(seconds * 1000 + 0.5))
+end
+
+--- @param attributes table<string, string|number|boolean>
+--- @return table
+local function encode_attributes(attributes)
+    local keys = {}
+    for key, _ in pairs(attributes) do
+        table.insert(keys, key)
+    end
+    table.sort(keys)
+    local encoded = {}
+    for _, key in ipairs(keys) do
+        local value = attributes[key]
+        local encoded_value
+        if type(value) == "boolean" then
+            encoded_value = { boolValue = value }
+        elseif type(value) == "number" and value == math.floor(value) then
+            encoded_value = { intValue = string.format("%d", value) }
+        elseif type(value) == "number" then
+            encoded_value = { doubleValue = value }
+        else
+            encoded_value = { stringValue = tostring(value) }
+        end
+        table.insert(encoded, { key = key, value = encoded_value })
+    end
+    return encoded
+end
+
+--- returns the OTLP ExportTraceServiceRequest of the spans
+--- @param spans Span[]
+--- @param service_name string
+--- @return table
+function get_export_request(spans, service_name)
+    local encoded_spans = {}
+    for _, span in ipairs(spans) do
+        local encoded_span = {
+            traceId = span.trace_id,
+            spanId = span.span_id,
+            parentSpanId = span.parent_span_id,
+            name = span.name,
+            kind = span.kind,
+            startTimeUnixNano = to_unix_nano(span.start_time),
+            endTimeUnixNano = to_unix_nano(span.end_time or span.start_time),
+            attributes = encode_attributes(span.attributes),
+        }
+        if #encoded_span.attributes == 0 then
+            encoded_span.attributes = nil
+        end
+        if span.error ~= nil then
+            encoded_span.status = { code = SPAN_STATUS_CODE_ERROR, message = span.error }
+        end
+        table.insert(encoded_spans, encoded_span)
+    end
+    return {
+        resourceSpans = {
+            {
+                resource = {
+                    attributes = encode_attributes({ ["service.name"] = service_name }),
+                },
+                scopeSpans = {
+                    {
+                        scope = { name = TRACING_SCOPE_NAME },
+                        spans = encoded_spans,
+                    },
+                },
+            },
+        },
+    }
+end
+
+--- @param size number bytes
+--- @return string hex encoded random id
+local function new_id(size)
+    local random = require "resty.random"
+    local str = require "resty.string"
+    return str.to_hex(random.bytes(size))
+end
+
+--- @return number
+local function now()
+    ngx.update_time()
+    return ngx.now()
+end
+
+--- sets the options, called in init_by_lua
+--- @param input_options TracingOptions
+local function init(input_options)
+    for key, value in pairs(input_options) do
+        options[key] = value
+    end
+    if not options.enabled then
+        return
+    end
+    local sample_ratio = tonumber(options.sample_ratio)
+    if sample_ratio == nil or sample_ratio < 0 or sample_ratio > 1 then
+        error("invalid tracing sample ratio " .. tostring(options.sample_ratio))
+    end
+    options.sample_ratio = sample_ratio
+    if utils.parse_duration(options.export_interval) == nil then
+        error("invalid tracing export interval " .. tostring(options.export_interval))
+    end
+    if type(options.endpoint) ~= "string" or not options.endpoint:match("^https?://") then
+        error("invalid tracing endpoint " .. tostring(options.endpoint))
+    end
+end
+
+--- starts the trace of the request and sets $tracing_traceparent forwarded to grafana.
+--- the trace is continued if the request has a valid traceparent header, called in the rewrite phase
+local function start_request()
+    if not options.enabled then
+        return
+    end
+    local context = parse_traceparent(ngx.req.get_headers()[TRACEPARENT_HEADER])
+    if context == nil then
+        context = {
+            trace_id = new_id(16),
+            parent_span_id = nil,
+            sampled = math.random() < options.sample_ratio,
+        }
+    end
+    local root = {
+        trace_id = context.trace_id,
+        span_id = new_id(8),
+        parent_span_id = context.parent_span_id,
+        name = ngx.req.get_method() .. " " .. ngx.var.uri,
+        kind = SPAN_KIND_SERVER,
+        start_time = ngx.req.start_time(),
+        attributes = {},
+    }
+    ngx.ctx.trace = {
+        sampled = context.sampled,
+        root = root,
+        current = root,
+        -- id of the grafana upstream span, known before the request is proxied
+        upstream_span_id = new_id(8),
+        spans = {},
+    }
+    ngx.var.tracing_traceparent = format_traceparent(context.trace_id, ngx.ctx.trace.upstream_span_id, context.sampled)
+end
+
+--- starts a child span of the current span, the new span becomes the current span until it is finished
+--- @param name string
+--- @param kind number|nil SPAN_KIND_INTERNAL by default
+--- @return Span|nil span returns `nil` if the request is not traced
+local function start_span(name, kind)
+    local trace = ngx.ctx.trace
+    if trace == nil then
+        return nil
+    end
+    local span = {
+        trace_id = trace.root.trace_id,
+        span_id = new_id(8),
+        parent_span_id = trace.current.span_id,
+        parent = trace.current,
+        name = name,
+        kind = kind or SPAN_KIND_INTERNAL,
+        start_time = now(),
+        attributes = {},
+    }
+    trace.current = span
+    return span
+end
+
+--- @param span Span|nil
+--- @param attributes table|nil
+--- @param error_message string|nil sets the span status to error
+local function finish_span(span, attributes, error_message)
+    local trace = ngx.ctx.trace
+    if span == nil or trace == nil then
+        return
+    end
+    span.end_time = now()
+    for key, value in pairs(attributes or {}) do
+        span.attributes[key] = value
+    end
+    if error_message ~= nil and string.len(error_message) ~= 0 then
+        span.error = error_message
+    end
+    if trace.current == span then
+        trace.current = span.parent or trace.root
+    end
+    span.parent = nil
+    table.insert(trace.spans, span)
+end
+
+--- returns the traceparent header of the outgoing request of the span
+--- @param span Span|nil
+--- @return string|nil
+local function get_traceparent(span)
+    local trace = ngx.ctx.trace
+    if span == nil or trace == nil then
+        return nil
+    end
+    return format_traceparent(span.trace_id, span.span_id, trace.sampled)
+end
+
+--- records the end of the rewrite phase, the cache lookup starts after the rewrite phase
+local function finish_rewrite()
+    if ngx.ctx.trace ~= nil then
+        ngx.ctx.trace.rewrite_end_time = now()
+    end
+end
+
+--- records the time the response headers are received, used for the cache lookup and upstream spans
+local function header_filter()
+    if ngx.ctx.trace ~= nil then
+        ngx.ctx.trace.header_time = now()
+    end
+end
+
+local function export(premature)
+    if #queue == 0 then
+        return
+    end
+    local spans = queue
+    queue = {}
+    local http = require "resty.http"
+    local http_client = http.new()
+    http_client:set_timeout(TRACING_EXPORT_TIMEOUT_MILLISECONDS)
+    local res, err = http_client:request_uri(options.endpoint, {
+        method = "POST",
+        headers = { ["Content-Type"] = "application/json" },
+        body = json.encode(get_export_request(spans, options.service_name)),
+    })
+    if res == nil then
+        ngx.log(ngx.STDERR, "failed to export ", #spans, " spans: ", err)
+        return
+    end
+    if res.status < 200 or res.status >= 300 then
+        ngx.log(ngx.STDERR, "failed to export ", #spans, " spans, collector returned ", res.status)
+    end
+end
+
+--- @param span Span
+local function enqueue(span)
+    if #queue >= TRACING_MAX_QUEUE_SIZE then
+        ngx.log(ngx.WARN, "tracing queue is full, span dropped")
+        return
+    end
+    table.insert(queue, span)
+end
+
+--- finishes the trace and queues the spans for the export, called in the log phase
+local function log()
+    local trace = ngx.ctx.trace
+    if trace == nil or not trace.sampled then
+        return
+    end
+    local root = trace.root
+    local end_time = now()
+    local cache_status = ngx.var.upstream_cache_status
+
+    -- cache lookup and upstream times are derived from the nginx upstream variables
+    local header_time = trace.header_time or end_time
+    local upstream_header_time = access_log.parse_upstream_time(ngx.var.upstream_header_time)
+    local upstream_start_time = nil
+    if upstream_header_time ~= nil then
+        upstream_start_time = header_time - upstream_header_time
+    end
+    if trace.rewrite_end_time ~= nil and cache_status ~= nil and cache_status ~= "" then
+        table.insert(trace.spans, {
+            trace_id = root.trace_id,
+            span_id = new_id(8),
+            parent_span_id = root.span_id,
+            name = "cache lookup",
+            kind = SPAN_KIND_INTERNAL,
+            start_time = trace.rewrite_end_time,
+            end_time = math.max(trace.rewrite_end_time, upstream_start_time or header_time),
+            attributes = { ["cache.status"] = cache_status },
+        })
+    end
+    if upstream_start_time ~= nil then
+        local upstream_response_time = access_log.parse_upstream_time(ngx.var.upstream_response_time) or upstream_header_time
+        table.insert(trace.spans, {
+            trace_id = root.trace_id,
+            span_id = trace.upstream_span_id,
+            parent_span_id = root.span_id,
+            name = "grafana " .. ngx.req.get_method() .. " " .. ngx.var.uri,
+            kind = SPAN_KIND_CLIENT,
+            start_time = upstream_start_time,
+            end_time = upstream_start_time + upstream_response_time,
+            attributes = {
+                ["http.response.status_code"] = tonumber(ngx.var.upstream_status),
+                ["server.address"] = ngx.var.grafana_host,
+            },
+        })
+    end
+
+    root.end_time = end_time
+    root.attributes = {
+        ["http.request.method"] = ngx.req.get_method(),
+        ["url.path"] = ngx.var.uri,
+        ["http.response.status_code"] = tonumber(ngx.var.status),
+        ["cache.status"] = cache_status,
+        ["cache.key"] = ngx.var.cache_key,
+        ["cache.config_id"] = ngx.var.cache_config_id,
+        ["cache.bypass_reason"] = ngx.var.cache_bypass_reason,
+        ["cache.access_denied"] = ngx.var.cache_access_denied == "1",
+    }
+    for key, value in pairs(root.attributes) do
+        if value == "" then
+            root.attributes[key] = nil
+        end
+    end
+    if tonumber(ngx.var.status) ~= nil and tonumber(ngx.var.status) >= 500 then
+        root.error = "status code " .. ngx.var.status
+    end
+    root.parent = nil
+    enqueue(root)
+    for _, span in ipairs(trace.spans) do
+        enqueue(span)
+    end
+    if #queue >= TRACING_MAX_EXPORT_BATCH_SIZE then
+        -- cosockets are not available in the log phase
+        ngx.timer.at(0, export)
+    end
+end
+
+--- starts the periodic export of the worker, called in init_worker_by_lua
+local function start()
+    if not options.enabled then
+        return
+    end
+    math.randomseed(ngx.now() * 1000 + ngx.worker.pid())
+    local ok, err = ngx.timer.every(utils.parse_duration(options.export_interval), export)
+    if not ok then
+        ngx.log(ngx.STDERR, "failed to start the span export: ", err)
+    end
+end
+
+return {
+    parse_traceparent = parse_traceparent,
+    format_traceparent = format_traceparent,
+    to_unix_nano = to_unix_nano,
+    get_export_request = get_export_request,
+    init = init,
+    start = start,
+    start_request = start_request,
+    start_span = start_span,
+    finish_span = finish_span,
+    get_traceparent = get_traceparent,
+    finish_rewrite = finish_rewrite,
+    header_filter = header_filter,
+    log = log,
+}
@@ -1,12 +1,653 @@
-function update_cache_key_prefix() 
-    local shared_dict = ngx.shared.shared
-    local timestamp = os.time(os.date("!*t"))
-    local success, err = shared_dict:set("cache_prefix", timestamp)
+-- cache key prefix (generation) used for invalidating the cache.
+-- the prefix is persisted in the state file so restarts keep the cache,
+-- and optionally synced through redis so an invalidation on one replica fans out to the others.
+-- the datasources and dashboards invalidated by /cache/webhook have their own generation (uid generations),
+-- the uids are only known at runtime so the uid generations share one state file and one redis hash.
+local json = require "cjson"
+local utils = require "utils"
+
+CACHE_KEY_PREFIX_KEY = "cache_prefix"
+CACHE_KEY_PREFIX_SYNC_REDIS = "redis"
+REDIS_TIMEOUT_MILLISECONDS = 1000
+UID_GENERATIONS_KEY = "uid_generations"
+UID_GENERATION_KIND_DATASOURCE = "datasource"
+UID_GENERATION_KIND_DASHBOARD = "dashboard"
+-- the registry of the uid generations is updated by the workers handling the webhook and by the sync timer
+UID_GENERATIONS_LOCK_KEY = "uid_generations_lock"
+UID_GENERATIONS_LOCK_TIMEOUT_SECONDS = 5
+UID_GENERATIONS_LOCK_RETRY_SECONDS = 0.01
+
+---@class CacheKeyPrefixOptions
+---@field state_file string file used to persist the prefix, empty to disable
+---@field sync string `off` or `redis`
+---@field redis_url string e.g. redis://:password@redis:6379/0
+---@field redis_key string
+---@field sync_interval string nginx style duration
+
+---@type CacheKeyPrefixOptions
+local options = {
+    state_file = "",
+    sync = "off",
+    redis_url = "",
+    redis_key = "",
+    sync_interval = "5s",
+}
+
+-- set if the prefix was generated during init because the state file didn't exist
+local prefix_generated_on_init = false
+-- names of the generations of the cache rules with invalidate_at, synced along with the global prefix
+local generation_names = {}
+
+---@class RedisOptions
+---@field host string
+---@field port number
+---@field password string|nil
+---@field database number
+
+--- parses redis://[[user]:password@]host[:port][/database]
+--- @param redis_url string
+--- @return RedisOptions|nil
+--- @return string errorMessage
+function parse_redis_url(redis_url)
+    local url_error = "invalid redis url, expected redis://[:password@]host[:port][/database]"
+    if type(redis_url) ~= "string" then
+        return nil, url_error
+    end
+    local rest = redis_url:match("^redis://(.+)$")
+    if rest == nil then
+        return nil, url_error
+    end
+    -- password may contain @, the address starts after the last @
+    local credentials, address_and_database = rest:match("^(.*)@(.+)$")
+    if credentials == nil then
+        address_and_database = rest
+    end
+    local host, port, database = address_and_database:match("^([^:/]+):?(%d*)/?(%d*)$")
+    if host == nil then
+        return nil, url_error
+    end
+    local password = nil
+    if credentials ~= nil and string.len(credentials) ~= 0 then
+        password = credentials:match("^[^:]*:(.+)$") or credentials
+    end
+    return {
+        host = host,
+        port = tonumber(port) or 6379,
+        password = password,
+        database = tonumber(database) or 0,
+    }, ""
+end
+
+--- returns the prefix which should be used after comparing the local and the synced prefix, newer prefix wins.
+--- prefer_remote is set if the local prefix was generated on startup (no state file),
+--- the replica then joins the generation of the other replicas
+--- @param local_prefix number|nil
+--- @param remote_prefix number|nil
+--- @param prefer_remote boolean
+--- @return number|nil prefix returns `nil` if the local prefix is up to date
+function get_newer_prefix(local_prefix, remote_prefix, prefer_remote)
+    if remote_prefix == nil or remote_prefix == local_prefix then
+        return nil
+    end
+    if prefer_remote or local_prefix == nil or remote_prefix > local_prefix then
+        return remote_prefix
+    end
+    return nil
+end
+
+--- @param file_path string
+--- @return number|nil
+function read_prefix_file(file_path)
+    local file = io.open(file_path, "rb")
+    if file == nil then
+        return nil
+    end
+    local content = file:read("*all")
+    file:close()
+    return tonumber(content:match("^%s*(%d+)%s*$"))
+end
+
+--- writes the content in a temp file and moves it, so the file is never partially written
+--- @param file_path string
+--- @param content string
+--- @return boolean success
+--- @return string errorMessage
+local function write_state_file(file_path, content)
+    local temp_file_path = file_path .. ".tmp"
+    local file, err = io.open(temp_file_path, "wb")
+    if file == nil then
+        return false, "unable to open " .. temp_file_path .. ", ERR: " .. tostring(err)
+    end
+    file:write(content)
+    file:close()
+    local success, rename_err = os.rename(temp_file_path, file_path)
+    if success == nil then
+        return false, "unable to rename " .. temp_file_path .. ", ERR: " .. tostring(rename_err)
+    end
+    return true, ""
+end
+
+--- @param file_path string
+--- @param prefix number
+--- @return boolean success
+--- @return string errorMessage
+function write_prefix_file(file_path, prefix)
+    return write_state_file(file_path, tostring(prefix))
+end
+
+--- reads the uid generations, invalid entries are ignored
+--- @param file_path string
+--- @return table<string, number> generations by name, empty if the file doesn't exist
+function read_generations_file(file_path)
+    local generations = {}
+    local file = io.open(file_path, "rb")
+    if file == nil then
+        return generations
+    end
+    local content = file:read("*all")
+    file:close()
+    local ok, decoded = pcall(json.decode, content)
+    if not ok or type(decoded) ~= "table" then
+        return generations
+    end
+    for name, prefix in pairs(decoded) do
+        if type(name) == "string" and tonumber(prefix) ~= nil then
+            generations[name] = tonumber(prefix)
+        end
+    end
+    return generations
+end
+
+--- @param file_path string
+--- @param generations table<string, number>
+--- @return boolean success
+--- @return string errorMessage
+function write_generations_file(file_path, generations)
+    return write_state_file(file_path, json.encode(generations))
+end
+
+--- returns the generations of `generations` newer than the `current` ones
+--- @param current table<string, number>
+--- @param generations table<string, number>
+--- @return table<string, number>
+function get_newer_generations(current, generations)
+    local newer = {}
+    for name, prefix in pairs(generations) do
+        if get_newer_prefix(current[name], prefix, false) ~= nil then
+            newer[name] = prefix
+        end
+    end
+    return newer
+end
+
+--- @param kind string UID_GENERATION_KIND_DATASOURCE or UID_GENERATION_KIND_DASHBOARD
+--- @param uid string
+--- @return string
+function get_uid_generation_name(kind, uid)
+    return kind .. ":" .. uid
+end
+
+--- generations are named prefixes used by the cache rules with invalidate_at, `nil` name is the global prefix
+--- @param name string|nil
+--- @return string
+function get_generation_shared_key(name)
+    if name == nil then
+        return CACHE_KEY_PREFIX_KEY
+    end
+    return CACHE_KEY_PREFIX_KEY .. ":" .. name
+end
+
+--- @param name string|nil
+--- @return string
+local function get_state_file(name)
+    if name == nil then
+        return options.state_file
+    end
+    return options.state_file .. "." .. name:gsub("[^%w_-]", "_")
+end
+
+--- @param name string|nil
+--- @return string
+local function get_redis_key(name)
+    if name == nil then
+        return options.redis_key
+    end
+    return options.redis_key .. ":" .. name
+end
+
+-- the uid generations use their own suffix, the named generations are suffixed with `.<name>` and `:<name>`
+--- @return string
+local function get_uid_generations_state_file()
+    return options.state_file .. "-uids"
+end
+
+--- @return string
+local function get_uid_generations_redis_key()
+    return options.redis_key .. "-uids"
+end
+
+--- @param name string see get_uid_generation_name
+--- @return string
+local function get_uid_generation_shared_key(name)
+    return UID_GENERATIONS_KEY .. ":" .. name
+end
+
+--- sets the prefix in the shared dict and the state file
+--- @param prefix number
+--- @param name string|nil
+local function set_prefix(prefix, name)
+    local success, err = ngx.shared.shared:set(get_generation_shared_key(name), prefix)
     if success ~= true then
         ngx.log(ngx.STDERR, "failed to set cache_key_prefix" .. err)
     end
+    if string.len(options.state_file) ~= 0 then
+        local written, errorMessage = write_prefix_file(get_state_file(name), prefix)
+        if not written then
+            ngx.log(ngx.STDERR, "failed to persist cache_key_prefix: ", errorMessage)
+        end
+    end
+end
+
+--- returns the registry of the uid generations
+--- @return table<string, number> generations by name
+local function get_uid_generations()
+    local value = ngx.shared.shared:get(UID_GENERATIONS_KEY)
+    if value == nil then
+        return {}
+    end
+    return json.decode(value)
+end
+
+--- runs the function while holding the lock of the uid generations
+--- @param fn function
+--- @return boolean success
+--- @return string errorMessage
+local function with_uid_generations_lock(fn)
+    local shared_dict = ngx.shared.shared
+    local waited = 0
+    while not shared_dict:add(UID_GENERATIONS_LOCK_KEY, true, UID_GENERATIONS_LOCK_TIMEOUT_SECONDS) do
+        if waited >= UID_GENERATIONS_LOCK_TIMEOUT_SECONDS then
+            return false, "timeout waiting for the uid generations lock"
+        end
+        ngx.sleep(UID_GENERATIONS_LOCK_RETRY_SECONDS)
+        waited = waited + UID_GENERATIONS_LOCK_RETRY_SECONDS
+    end
+    local ok, err = pcall(fn)
+    shared_dict:delete(UID_GENERATIONS_LOCK_KEY)
+    if not ok then
+        return false, tostring(err)
+    end
+    return true, ""
+end
+
+--- sets the uid generations newer than the current ones in the shared dict and the state file
+--- @param generations table<string, number>
+--- @return table<string, number>|nil newer the updated generations
+--- @return string errorMessage
+local function set_uid_generations(generations)
+    local newer = {}
+    local ok, errorMessage = with_uid_generations_lock(function()
+        local registry = get_uid_generations()
+        newer = get_newer_generations(registry, generations)
+        if next(newer) == nil then
+            return
+        end
+        local shared_dict = ngx.shared.shared
+        for name, prefix in pairs(newer) do
+            registry[name] = prefix
+            local success, err = shared_dict:set(get_uid_generation_shared_key(name), prefix)
+            if success ~= true then
+                error("failed to set the uid generation " .. name .. " " .. tostring(err))
+            end
+        end
+        local success, err = shared_dict:set(UID_GENERATIONS_KEY, json.encode(registry))
+        if success ~= true then
+            error("failed to set the uid generations " .. tostring(err))
+        end
+        if string.len(options.state_file) ~= 0 then
+            local written, writeErrorMessage = write_generations_file(get_uid_generations_state_file(), registry)
+            if not written then
+                ngx.log(ngx.STDERR, "failed to persist the uid generations: ", writeErrorMessage)
+            end
+        end
+    end)
+    if not ok then
+        return nil, errorMessage
+    end
+    return newer, ""
+end
+
+--- connects to redis, redis can only be used in the phases supporting cosockets (not in init_by_lua)
+--- @return table|nil redis
+--- @return string errorMessage
+local function connect_redis()
+    local redis_options, errorMessage = parse_redis_url(options.redis_url)
+    if redis_options == nil then
+        return nil, errorMessage
+    end
+    local redis = require "resty.redis"
+    local client = redis:new()
+    client:set_timeout(REDIS_TIMEOUT_MILLISECONDS)
+    local ok, err = client:connect(redis_options.host, redis_options.port)
+    if not ok then
+        return nil, "unable to connect to redis: " .. tostring(err)
+    end
+    if redis_options.password ~= nil then
+        ok, err = client:auth(redis_options.password)
+        if not ok then
+            return nil, "redis auth failed: " .. tostring(err)
+        end
+    end
+    if redis_options.database ~= 0 then
+        ok, err = client:select(redis_options.database)
+        if not ok then
+            return nil, "redis select failed: " .. tostring(err)
+        end
+    end
+    return client, ""
+end
+
+--- @param client table
+local function release_redis(client)
+    local ok, err = client:set_keepalive(60000, 10)
+    if not ok then
+        ngx.log(ngx.DEBUG, "unable to set redis keepalive: ", err)
+    end
+end
+
+--- @return boolean
+local function is_sync_enabled()
+    return options.sync == CACHE_KEY_PREFIX_SYNC_REDIS
+end
+
+--- publishes the prefix for the other replicas
+--- @param prefix number
+--- @param name string|nil
+--- @return boolean success
+--- @return string errorMessage
+local function publish_prefix(prefix, name)
+    local client, errorMessage = connect_redis()
+    if client == nil then
+        return false, errorMessage
+    end
+    local ok, err = client:set(get_redis_key(name), tostring(prefix))
+    release_redis(client)
+    if not ok then
+        return false, "redis set failed: " .. tostring(err)
+    end
+    return true, ""
+end
+
+--- publishes the uid generations for the other replicas
+--- @param client table
+--- @param generations table<string, number>
+--- @return boolean success
+--- @return string errorMessage
+local function publish_uid_generations(client, generations)
+    local ok, err = client:hmset(get_uid_generations_redis_key(), generations)
+    if not ok then
+        return false, "redis hmset failed: " .. tostring(err)
+    end
+    return true, ""
+end
+
+--- pulls the uid generations published by the other replicas, the newer local generations are published
+--- @param client table
+local function sync_uid_generations(client)
+    local values, err = client:hgetall(get_uid_generations_redis_key())
+    if values == nil then
+        ngx.log(ngx.STDERR, "uid generations sync failed: ", err)
+        return
+    end
+    local remote_generations = {}
+    for i = 1, #values, 2 do
+        local prefix = tonumber(values[i + 1])
+        if prefix ~= nil then
+            remote_generations[values[i]] = prefix
+        end
+    end
+    local newer, errorMessage = set_uid_generations(remote_generations)
+    if newer == nil then
+        ngx.log(ngx.STDERR, "uid generations sync failed: ", errorMessage)
+        return
+    end
+    for name, prefix in pairs(newer) do
+        ngx.log(ngx.INFO, "uid generation ", name, " updated by another replica: ", prefix)
+    end
+    local unpublished = get_newer_generations(remote_generations, get_uid_generations())
+    if next(unpublished) ~= nil then
+        local published, publishErrorMessage = publish_uid_generations(client, unpublished)
+        if not published then
+            ngx.log(ngx.STDERR, "uid generations publish failed: ", publishErrorMessage)
+        end
+    end
+end
+
+--- @param client table
+--- @param name string|nil
+local function sync_generation(client, name)
+    local value, err = client:get(get_redis_key(name))
+    if err ~= nil then
+        ngx.log(ngx.STDERR, "cache_key_prefix sync failed: ", err)
+        return
+    end
+
+    local local_prefix = get_generation(name)
+    local remote_prefix = tonumber(value)
+    local prefer_remote = name == nil and prefix_generated_on_init
+    if name == nil then
+        prefix_generated_on_init = false
+    end
+    if remote_prefix == nil and local_prefix ~= nil then
+        local ok, set_err = client:set(get_redis_key(name), tostring(local_prefix))
+        if not ok then
+            ngx.log(ngx.STDERR, "cache_key_prefix publish failed: ", set_err)
+        end
+        return
+    end
+    local newer_prefix = get_newer_prefix(local_prefix, remote_prefix, prefer_remote)
+    if newer_prefix ~= nil then
+        ngx.log(ngx.INFO, "cache_key_prefix ", name or "", " updated by another replica: ", newer_prefix)
+        set_prefix(newer_prefix, name)
+    end
+end
+
+--- pulls the prefixes published by the other replicas, the local prefix is published if the redis key is missing
+local function sync_prefix(premature)
+    if premature then
+        return
+    end
+    local client, errorMessage = connect_redis()
+    if client == nil then
+        ngx.log(ngx.STDERR, "cache_key_prefix sync failed: ", errorMessage)
+        return
+    end
+    sync_generation(client, nil)
+    for _, name in ipairs(generation_names) do
+        sync_generation(client, name)
+    end
+    sync_uid_generations(client)
+    release_redis(client)
+end
+
+--- sets the options and loads the persisted prefix, a new prefix is generated if the state file doesn't exist.
+--- called in init_by_lua
+--- @param input_options CacheKeyPrefixOptions
+local function init(input_options)
+    for key, value in pairs(input_options) do
+        options[key] = value
+    end
+    if is_sync_enabled() then
+        local _, errorMessage = parse_redis_url(options.redis_url)
+        if string.len(errorMessage) ~= 0 then
+            error(errorMessage)
+        end
+        if utils.parse_duration(options.sync_interval) == nil then
+            error("invalid cache key prefix sync interval " .. tostring(options.sync_interval))
+        end
+    end
+    if load_generation(nil) == nil then
+        update_cache_key_prefix()
+        prefix_generated_on_init = true
+    end
+    if string.len(options.state_file) ~= 0 then
+        local _, errorMessage = set_uid_generations(read_generations_file(get_uid_generations_state_file()))
+        if string.len(errorMessage) ~= 0 then
+            error(errorMessage)
+        end
+    end
+end
+
+--- loads the persisted generation and includes it in the sync, called in init_by_lua
+--- @param name string|nil
+--- @return number|nil prefix returns `nil` if the generation was not persisted
+function load_generation(name)
+    if name ~= nil then
+        table.insert(generation_names, name)
+    end
+    if string.len(options.state_file) == 0 then
+        return nil
+    end
+    local prefix = read_prefix_file(get_state_file(name))
+    if prefix == nil then
+        return nil
+    end
+    local success, err = ngx.shared.shared:set(get_generation_shared_key(name), prefix)
+    if success ~= true then
+        error("failed to set cache_key_prefix " .. tostring(err))
+    end
+    return prefix
+end
+
+--- @param name string|nil
+--- @return number|nil
+function get_generation(name)
+    return tonumber(ngx.shared.shared:get(get_generation_shared_key(name)))
+end
+
+--- starts the periodic sync, called in init_worker_by_lua
+local function start_sync()
+    if not is_sync_enabled() or ngx.worker.id() ~= 0 then
+        return
+    end
+    ngx.timer.at(0, sync_prefix)
+    local ok, err = ngx.timer.every(utils.parse_duration(options.sync_interval), sync_prefix)
+    if not ok then
+        ngx.log(ngx.STDERR, "failed to start cache_key_prefix sync: ", err)
+    end
+end
+
+--- sets the generation if it is newer than the current one, used by the scheduled invalidation
+--- @param prefix number
+--- @param name string|nil
+--- @return boolean updated
+--- @return string errorMessage not empty if the prefix could not be published for the other replicas
+function advance_generation(prefix, name)
+    local current_prefix = get_generation(name)
+    if current_prefix ~= nil and current_prefix >= prefix then
+        return false, ""
+    end
+    set_prefix(prefix, name)
+    if is_sync_enabled() and ngx.get_phase() ~= "init" then
+        local published, errorMessage = publish_prefix(prefix, name)
+        if not published then
+            ngx.log(ngx.STDERR, "cache_key_prefix publish failed: ", errorMessage)
+            return true, errorMessage
+        end
+    end
+    return true, ""
+end
+
+--- generates a new prefix which invalidates all the cached responses
+--- @return number prefix
+--- @return string errorMessage not empty if the prefix could not be published for the other replicas
+function update_cache_key_prefix()
+    local timestamp = os.time(os.date("!*t"))
+    set_prefix(timestamp)
+    -- cosockets are not available during init, the prefix is published by the first sync
+    if is_sync_enabled() and ngx.get_phase() ~= "init" then
+        local published, errorMessage = publish_prefix(timestamp)
+        if not published then
+            ngx.log(ngx.STDERR, "cache_key_prefix publish failed: ", errorMessage)
+            return timestamp, errorMessage
+        end
+    end
+    return timestamp, ""
+end
+
+--- returns the uid generations of the datasources and the dashboard of a request for the cache key,
+--- `<name>=<generation>` sorted by name and separated by commas, empty if none of the uids was invalidated
+--- @param datasource_uids string[]
+--- @param dashboard_uid string|nil
+--- @return string
+function get_uid_generations_cache_key(datasource_uids, dashboard_uid)
+    local names = {}
+    for _, uid in ipairs(datasource_uids) do
+        table.insert(names, get_uid_generation_name(UID_GENERATION_KIND_DATASOURCE, uid))
+    end
+    if type(dashboard_uid) == "string" and string.len(dashboard_uid) ~= 0 then
+        table.insert(names, get_uid_generation_name(UID_GENERATION_KIND_DASHBOARD, dashboard_uid))
+    end
+    table.sort(names)
+    local generations = {}
+    for _, name in ipairs(names) do
+        local prefix = ngx.shared.shared:get(get_uid_generation_shared_key(name))
+        if prefix ~= nil then
+            table.insert(generations, name .. "=" .. tostring(prefix))
+        end
+    end
+    return table.concat(generations, ",")
+end
+
+--- advances the generations of the uids, invalidates the cached responses of the datasources and dashboards
+--- on every replica (the new generations are published) and after a restart (the generations are persisted).
+--- a generation is always incremented, even if the uid is invalidated twice within the same second
+--- @param names string[] see get_uid_generation_name
+--- @return table<string, number>|nil generations new generation by name
+--- @return string errorMessage not empty if the generations could not be set or published for the other replicas
+function invalidate_uids(names)
+    local now = ngx.time()
+    local registry = get_uid_generations()
+    local generations = {}
+    for _, name in ipairs(names) do
+        generations[name] = math.max(now, (registry[name] or 0) + 1)
+    end
+    local _, errorMessage = set_uid_generations(generations)
+    if string.len(errorMessage) ~= 0 then
+        return nil, errorMessage
+    end
+    if is_sync_enabled() then
+        local client, connectErrorMessage = connect_redis()
+        if client == nil then
+            ngx.log(ngx.STDERR, "uid generations publish failed: ", connectErrorMessage)
+            return generations, connectErrorMessage
+        end
+        local published, publishErrorMessage = publish_uid_generations(client, generations)
+        release_redis(client)
+        if not published then
+            ngx.log(ngx.STDERR, "uid generations publish failed: ", publishErrorMessage)
+            return generations, publishErrorMessage
+        end
+    end
+    return generations, ""
 end
 
 return {
+    parse_redis_url = parse_redis_url,
+    get_newer_prefix = get_newer_prefix,
+    read_prefix_file = read_prefix_file,
+    write_prefix_file = write_prefix_file,
+    read_generations_file = read_generations_file,
+    write_generations_file = write_generations_file,
+    get_newer_generations = get_newer_generations,
+    get_uid_generation_name = get_uid_generation_name,
+    get_generation_shared_key = get_generation_shared_key,
+    init = init,
+    load_generation = load_generation,
+    get_generation = get_generation,
+    start_sync = start_sync,
+    advance_generation = advance_generation,
     update_cache_key_prefix = update_cache_key_prefix,
-}
\ No newline at end of file
+    get_uid_generations_cache_key = get_uid_generations_cache_key,
+    invalidate_uids = invalidate_uids,
+}
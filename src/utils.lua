@@ -1,3 +1,12 @@
+local json = require "cjson";
+
+-- cjson instance for the bodies which are decoded and encoded again (proxied request body, cache metadata),
+-- empty arrays must stay arrays and the values should keep their precision
+local roundtrip_json = json.new()
+roundtrip_json.decode_array_with_array_mt(true)
+roundtrip_json.encode_number_precision(16)
+roundtrip_json.encode_escape_forward_slash(false)
+
 --- usage = check_table_type(table, { {key = "name", type = "string"}, {key = "age", type = "number"},  })
 --- @param input_table table
 --- @param key_types table
@@ -51,8 +60,153 @@ function table_length(t)
     return count
   end
 
+---returns true if the array contains the value
+---@param t table
+---@param value any
+---@return boolean
+function table_contains(t, value)
+    for _, item in ipairs(t) do
+        if item == value then
+            return true
+        end
+    end
+    return false
+end
+
+---splits the input string on separator and trims whitespace around each item, empty items are skipped
+---@usage split_string("a, b,c", ",") -- { "a", "b", "c" }
+---@param input string
+---@param separator string
+---@return table
+function split_string(input, separator)
+    local items = {}
+    if type(input) ~= "string" then
+        return items
+    end
+    for item in string.gmatch(input, "[^" .. separator .. "]+") do
+        item = item:match("^%s*(.-)%s*$")
+        if string.len(item) > 0 then
+            table.insert(items, item)
+        end
+    end
+    return items
+end
+
+SIZE_UNITS = {
+    [""] = 1,
+    k = 1024,
+    m = 1024 * 1024,
+    g = 1024 * 1024 * 1024,
+}
+
+---converts nginx style size to bytes
+---@usage parse_size("10m") -- 10485760
+---@param size string|number
+---@return number|nil bytes returns `nil` if the size is invalid
+function parse_size(size)
+    if type(size) == "number" then
+        return size
+    end
+    if type(size) ~= "string" then
+        return nil
+    end
+    local value, unit = string.match(size, "^%s*(%d+)%s*([kKmMgG]?)%s*$")
+    if value == nil then
+        return nil
+    end
+    return tonumber(value) * SIZE_UNITS[string.lower(unit)]
+end
+
+DURATION_UNITS = {
+    ns = 0.000000001,
+    us = 0.000001,
+    ms = 0.001,
+    s = 1,
+    m = 60,
+    h = 60 * 60,
+    d = 24 * 60 * 60,
+    w = 7 * 24 * 60 * 60,
+    M = 30 * 24 * 60 * 60,
+    y = 365 * 24 * 60 * 60,
+}
+
+---converts nginx or go style duration to seconds, number without unit is in seconds
+---@usage parse_duration("1h30m") -- 5400
+---@usage parse_duration("1.5h") -- 5400
+---@param duration string|number
+---@return number|nil seconds returns `nil` if the duration is invalid
+function parse_duration(duration)
+    if type(duration) == "number" then
+        return duration
+    end
+    if type(duration) ~= "string" then
+        return nil
+    end
+    duration = duration:gsub("%s", "")
+    if string.len(duration) == 0 then
+        return nil
+    end
+    if duration:match("^%d+$") then
+        return tonumber(duration)
+    end
+    local seconds = 0
+    local parsed_length = 0
+    for value, unit in duration:gmatch("([%d%.]+)(%a+)") do
+        if DURATION_UNITS[unit] == nil or tonumber(value) == nil then
+            return nil
+        end
+        seconds = seconds + tonumber(value) * DURATION_UNITS[unit]
+        parsed_length = parsed_length + string.len(value) + string.len(unit)
+    end
+    if parsed_length ~= string.len(duration) then
+        return nil
+    end
+    return seconds
+end
+
+---converts a file name glob to a lua pattern, `*` matches any characters and `?` one character except `/`
+---@usage glob_to_pattern("*.yaml") -- "^[^/]*%.yaml$"
+---@param glob string
+---@return string
+function glob_to_pattern(glob)
+    local pattern = glob:gsub("[%^%$%(%)%%%.%[%]%+%-]", "%%%0"):gsub("%*", "[^/]*"):gsub("%?", "[^/]")
+    return "^" .. pattern .. "$"
+end
+
+--- returns the request body, the body is read from the temp file if nginx buffered it to a file
+--- (larger than client_body_buffer_size)
+---@return string|nil body_data returns `nil` if the request doesn't have a body
+function get_body_data()
+    ngx.req.read_body()
+    ---@type string|nil
+    local body_data = ngx.req.get_body_data()
+    if body_data then
+        return body_data
+    end
+    local body_file = ngx.req.get_body_file()
+    if not body_file then
+        return nil
+    end
+    -- we are not checking the body size before reading it into memory, CLIENT_MAX_BODY_SIZE limits it
+    local file = io.open(body_file, "rb")
+    if not file then
+        ngx.log(ngx.STDERR, "unable to open request file")
+        return nil
+    end
+    body_data = file:read("*all")
+    file:close()
+    return body_data
+end
+
 return {
     check_table_type = check_table_type,
     table_length = table_length,
-    check_type = check_type
+    table_contains = table_contains,
+    check_type = check_type,
+    split_string = split_string,
+    parse_size = parse_size,
+    parse_duration = parse_duration,
+    glob_to_pattern = glob_to_pattern,
+    get_body_data = get_body_data,
+    roundtrip_json = roundtrip_json
 }
\ No newline at end of file
@@ -0,0 +1,181 @@
+-- /cache/webhook, invalidates the cache entries of the datasources/dashboards in the payload.
+-- accepts the payload of the grafana webhook contact point (alerting) or the simple payload documented in docs/configuration.md,
+-- the datasources and dashboards get a new generation (see update_cache_key_prefix.lua), the cached responses found
+-- in the cache index (see cache_index.lua) are removed.
+local json = require "cjson";
+local cache_index = require "cache_index"
+local update_cache_key_prefix = require "update_cache_key_prefix"
+local cache_file = require "cache_file"
+local utils = require "utils"
+
+-- alert labels/annotations containing the uids, __dashboardUid__ is set by grafana on the alert rules linked to a dashboard
+WEBHOOK_DATASOURCE_UID_KEYS = { "datasource_uid" }
+WEBHOOK_DASHBOARD_UID_KEYS = { "dashboard_uid", "__dashboardUid__" }
+
+---@class WebhookScope
+---@field datasource_uids table<string, boolean>
+---@field dashboard_uids table<string, boolean>
+
+--- @param uids table<string, boolean>
+--- @param value any
+local function add_uid(uids, value)
+    if type(value) == "string" and string.len(value) ~= 0 then
+        uids[value] = true
+    end
+end
+
+--- @param uids table<string, boolean>
+--- @param values any
+--- @return boolean valid
+local function add_uid_list(uids, values)
+    if values == nil then
+        return true
+    end
+    if type(values) ~= "table" then
+        return false
+    end
+    for _, value in ipairs(values) do
+        add_uid(uids, value)
+    end
+    return true
+end
+
+--- parses the webhook payload.
+--- simple payload: {"datasource_uids": ["..."], "dashboard_uids": ["..."]}
+--- grafana webhook contact point: {"alerts": [{"status": "firing", "labels": {"datasource_uid": "..."}, "annotations": {"__dashboardUid__": "..."}}]},
+--- resolved alerts are ignored
+--- @param body string|nil
+--- @return WebhookScope|nil scope
+--- @return string errorMessage
+function parse_webhook_payload(body)
+    if type(body) ~= "string" or string.len(body) == 0 then
+        return nil, "empty payload"
+    end
+    local ok, payload = pcall(json.decode, body)
+    if not ok or type(payload) ~= "table" then
+        return nil, "invalid json payload"
+    end
+
+    local scope = { datasource_uids = {}, dashboard_uids = {} }
+    if not add_uid_list(scope.datasource_uids, payload.datasource_uids) then
+        return nil, "datasource_uids should be an array"
+    end
+    if not add_uid_list(scope.dashboard_uids, payload.dashboard_uids) then
+        return nil, "dashboard_uids should be an array"
+    end
+    if type(payload.alerts) == "table" then
+        for _, alert in ipairs(payload.alerts) do
+            if type(alert) == "table" and alert.status ~= "resolved" then
+                for _, values in ipairs({ alert.labels, alert.annotations }) do
+                    if type(values) == "table" then
+                        for _, key in ipairs(WEBHOOK_DATASOURCE_UID_KEYS) do
+                            add_uid(scope.datasource_uids, values[key])
+                        end
+                        for _, key in ipairs(WEBHOOK_DASHBOARD_UID_KEYS) do
+                            add_uid(scope.dashboard_uids, values[key])
+                        end
+                    end
+                end
+            end
+        end
+    end
+    if next(scope.datasource_uids) == nil and next(scope.dashboard_uids) == nil then
+        return nil, "no datasource or dashboard uid in the payload"
+    end
+    return scope, ""
+end
+
+--- returns true if the cache entry queries any of the datasources or was requested by any of the dashboards
+--- @param entry CacheIndexEntry
+--- @param scope WebhookScope
+--- @return boolean
+function entry_matches_scope(entry, scope)
+    for _, uid in ipairs(entry.datasource_uids or {}) do
+        if scope.datasource_uids[uid] then
+            return true
+        end
+    end
+    for _, uid in ipairs(entry.dashboard_uids or {}) do
+        if scope.dashboard_uids[uid] then
+            return true
+        end
+    end
+    return false
+end
+
+--- returns the names of the uid generations of the scope, sorted
+--- @param scope WebhookScope
+--- @return string[]
+function get_scope_generation_names(scope)
+    local names = {}
+    for uid in pairs(scope.datasource_uids) do
+        table.insert(names, update_cache_key_prefix.get_uid_generation_name(UID_GENERATION_KIND_DATASOURCE, uid))
+    end
+    for uid in pairs(scope.dashboard_uids) do
+        table.insert(names, update_cache_key_prefix.get_uid_generation_name(UID_GENERATION_KIND_DASHBOARD, uid))
+    end
+    table.sort(names)
+    return names
+end
+
+--- content handler of /cache/webhook
+--- the generations of the uids are advanced, so the cache keys of their requests change on every replica.
+--- the cached responses of the indexed entries are then removed to free the disk space (best effort,
+--- the files which could not be removed are evicted by nginx once inactive)
+local function serve_webhook()
+    local scope, errorMessage = parse_webhook_payload(utils.get_body_data())
+    if scope == nil then
+        return cache_index.send_json(ngx.HTTP_BAD_REQUEST, { error = errorMessage })
+    end
+
+    local names = get_scope_generation_names(scope)
+    local generations, syncErrorMessage = update_cache_key_prefix.invalidate_uids(names)
+    if generations == nil then
+        ngx.log(ngx.STDERR, "webhook invalidation failed: ", syncErrorMessage)
+        return cache_index.send_json(ngx.HTTP_INTERNAL_SERVER_ERROR, { error = syncErrorMessage })
+    end
+
+    local index = ngx.shared.cache_index
+    local removed_keys = {}
+    local failed_keys = {}
+    for _, entry in ipairs(cache_index.list_entries(index, ngx.time())) do
+        if entry_matches_scope(entry, scope) then
+            local deleted, deleteErrorMessage = cache_file.delete_cache_file(ngx.var.cache_directory, entry.key)
+            -- the cache file doesn't exist if the response was not stored or was already evicted by nginx
+            if not deleted and cache_file.cache_file_exists(ngx.var.cache_directory, entry.key) then
+                ngx.log(ngx.WARN, "cache file not removed for ", entry.key, " ", deleteErrorMessage)
+                table.insert(failed_keys, entry.key)
+            else
+                table.insert(removed_keys, entry.key)
+            end
+            cache_index.delete_entry(index, entry.key)
+        end
+    end
+    ngx.log(ngx.NOTICE, "webhook invalidated ", #names, " uids, removed ",
+        #removed_keys, " cache entries, ", #failed_keys, " not removed")
+    if #removed_keys == 0 then
+        removed_keys = json.empty_array
+    end
+    if #failed_keys == 0 then
+        failed_keys = json.empty_array
+    end
+    local response = {
+        generations = generations,
+        removed = removed_keys,
+        failed = failed_keys,
+    }
+    local status = ngx.HTTP_OK
+    if string.len(syncErrorMessage) ~= 0 then
+        -- invalidated on this replica only
+        status = ngx.HTTP_INTERNAL_SERVER_ERROR
+        response.error = "cache invalidated locally, sync failed: " .. syncErrorMessage
+    end
+    return cache_index.send_json(status, response)
+end
+
+return {
+    parse_webhook_payload = parse_webhook_payload,
+    entry_matches_scope = entry_matches_scope,
+    get_scope_generation_names = get_scope_generation_names,
+    serve_webhook = serve_webhook
+}
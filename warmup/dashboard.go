@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	grafanaGridColumns           = 24
+	prometheusDatasourceType     = "prometheus"
+	prometheusDefaultMinInterval = 15 * time.Second
+	mixedDatasourceUID           = "-- Mixed --"
+)
+
+type datasourceRef struct {
+	Type string `json:"type"`
+	UID  string `json:"uid"`
+}
+
+type templateVariable struct {
+	Name    string `json:"name"`
+	Current struct {
+		Value any `json:"value"`
+	} `json:"current"`
+}
+
+type panel struct {
+	ID            int              `json:"id"`
+	Type          string           `json:"type"`
+	Title         string           `json:"title"`
+	Datasource    any              `json:"datasource"`
+	Targets       []map[string]any `json:"targets"`
+	MaxDataPoints *int64           `json:"maxDataPoints"`
+	Interval      string           `json:"interval"`
+	GridPos       struct {
+		W int `json:"w"`
+	} `json:"gridPos"`
+	// panels of the collapsed row
+	Panels []panel `json:"panels"`
+}
+
+type dashboard struct {
+	UID   string `json:"uid"`
+	Title string `json:"title"`
+	Time  struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	} `json:"time"`
+	Panels     []panel `json:"panels"`
+	Templating struct {
+		List []templateVariable `json:"list"`
+	} `json:"templating"`
+}
+
+type queryRequestBody struct {
+	From    string           `json:"from"`
+	To      string           `json:"to"`
+	Queries []map[string]any `json:"queries"`
+}
+
+// warmupRequest is the /api/ds/query request of one panel for one time range
+type warmupRequest struct {
+	DashboardUID   string
+	PanelID        int
+	PanelTitle     string
+	DatasourceType string
+	Body           queryRequestBody
+}
+
+type buildOptions struct {
+	// width of the dashboard in pixels, used for the panel maxDataPoints
+	DashboardWidth int
+	MinInterval    time.Duration
+	UtcOffsetSec   int
+	// returns the numeric datasource id for the datasource uid, grafana frontend adds it in every query
+	DatasourceID func(uid string) (int64, bool)
+}
+
+// loadDashboards loads the dashboard json files, directories are scanned for *.json files
+func loadDashboards(paths []string) (dashboards []dashboard, err error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("[loadDashboards] unable to stat \"%s\": %w", path, err)
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(path, "*.json"))
+		if err != nil {
+			return nil, fmt.Errorf("[loadDashboards] unable to list \"%s\": %w", path, err)
+		}
+		sort.Strings(matches)
+		files = append(files, matches...)
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("[loadDashboards] unable to read \"%s\": %w", file, err)
+		}
+		var d dashboard
+		if err := json.Unmarshal(data, &d); err != nil {
+			return nil, fmt.Errorf("[loadDashboards] invalid dashboard json \"%s\": %w", file, err)
+		}
+		dashboards = append(dashboards, d)
+	}
+	return
+}
+
+// flattenPanels returns all the panels including the panels of collapsed rows
+func flattenPanels(panels []panel) (flattened []panel) {
+	for _, p := range panels {
+		flattened = append(flattened, p)
+		flattened = append(flattened, flattenPanels(p.Panels)...)
+	}
+	return
+}
+
+// parseDatasourceRef returns the datasource reference, dashboards older than grafana 8.3 use the datasource name
+// which can not be resolved without extra api calls, those are ignored
+func parseDatasourceRef(value any) (ref datasourceRef, ok bool) {
+	object, isObject := value.(map[string]any)
+	if !isObject {
+		return ref, false
+	}
+	ref.Type, _ = object["type"].(string)
+	ref.UID, _ = object["uid"].(string)
+	return ref, len(ref.UID) != 0
+}
+
+// buildRequests returns the query requests for all the panels of the dashboard and time ranges
+func buildRequests(d dashboard, ranges []timeRange, options buildOptions) (requests []warmupRequest, warnings []string) {
+	variables := getVariableValues(d.Templating.List)
+	for _, p := range flattenPanels(d.Panels) {
+		if len(p.Targets) == 0 {
+			continue
+		}
+		panelDatasource, hasPanelDatasource := parseDatasourceRef(p.Datasource)
+		for _, r := range ranges {
+			request := warmupRequest{
+				DashboardUID: d.UID,
+				PanelID:      p.ID,
+				PanelTitle:   p.Title,
+				Body: queryRequestBody{
+					From: strconv.FormatInt(r.From.UnixMilli(), 10),
+					To:   strconv.FormatInt(r.To.UnixMilli(), 10),
+				},
+			}
+			for _, target := range p.Targets {
+				if hidden, _ := target["hide"].(bool); hidden {
+					continue
+				}
+				targetDatasource, ok := parseDatasourceRef(target["datasource"])
+				if !ok || targetDatasource.UID == mixedDatasourceUID {
+					targetDatasource, ok = panelDatasource, hasPanelDatasource
+				}
+				if !ok || targetDatasource.UID == mixedDatasourceUID {
+					warnings = append(warnings, fmt.Sprintf("dashboard %s panel %d: target without datasource uid ignored", d.UID, p.ID))
+					continue
+				}
+				query := interpolateVariables(target, variables).(map[string]any)
+				addRequestFields(query, p, targetDatasource, r, options)
+				request.Body.Queries = append(request.Body.Queries, query)
+				request.DatasourceType = targetDatasource.Type
+			}
+			if len(request.Body.Queries) != 0 {
+				requests = append(requests, request)
+			}
+		}
+	}
+	return
+}
+
+// addRequestFields adds the fields added by the grafana frontend in the /api/ds/query request,
+// the cache key depends on all the query fields
+func addRequestFields(query map[string]any, p panel, datasource datasourceRef, r timeRange, options buildOptions) {
+	maxDataPoints := int64(options.DashboardWidth * p.GridPos.W / grafanaGridColumns)
+	if p.MaxDataPoints != nil {
+		maxDataPoints = *p.MaxDataPoints
+	}
+	minInterval := options.MinInterval
+	if interval, err := time.ParseDuration(p.Interval); err == nil {
+		minInterval = interval
+	}
+	if minInterval == 0 && datasource.Type == prometheusDatasourceType {
+		// default scrape interval of the prometheus datasource
+		minInterval = prometheusDefaultMinInterval
+	}
+
+	query["datasource"] = map[string]any{
+		"type": datasource.Type,
+		"uid":  datasource.UID,
+	}
+	if options.DatasourceID != nil {
+		if id, ok := options.DatasourceID(datasource.UID); ok {
+			query["datasourceId"] = id
+		}
+	}
+	query["intervalMs"] = calculateIntervalMs(r, maxDataPoints, minInterval)
+	query["maxDataPoints"] = maxDataPoints
+	if datasource.Type == prometheusDatasourceType {
+		// added by the grafana prometheus datasource
+		query["requestId"] = fmt.Sprintf("%d%v", p.ID, query["refId"])
+		query["utcOffsetSec"] = options.UtcOffsetSec
+	}
+}
+
+// getVariableValues returns the current value of the dashboard variables, multi value variables are joined using comma
+func getVariableValues(list []templateVariable) map[string]string {
+	values := make(map[string]string)
+	for _, variable := range list {
+		switch value := variable.Current.Value.(type) {
+		case string:
+			values[variable.Name] = value
+		case []any:
+			items := make([]string, 0, len(value))
+			for _, item := range value {
+				items = append(items, fmt.Sprint(item))
+			}
+			values[variable.Name] = strings.Join(items, ",")
+		}
+	}
+	return values
+}
+
+var variablePattern = regexp.MustCompile(`\$\{(\w+)(:\w+)?\}|\[\[(\w+)\]\]|\$(\w+)`)
+
+// interpolateVariables replaces $var, ${var} and [[var]] in all the string values.
+// grafana built-in variables ($__interval, $__range, ...) and unknown variables are left as is
+func interpolateVariables(value any, variables map[string]string) any {
+	switch v := value.(type) {
+	case string:
+		return variablePattern.ReplaceAllStringFunc(v, func(match string) string {
+			groups := variablePattern.FindStringSubmatch(match)
+			name := groups[1] + groups[3] + groups[4]
+			if replacement, ok := variables[name]; ok && !strings.HasPrefix(name, "__") {
+				return replacement
+			}
+			return match
+		})
+	case map[string]any:
+		interpolated := make(map[string]any, len(v))
+		for key, item := range v {
+			interpolated[key] = interpolateVariables(item, variables)
+		}
+		return interpolated
+	case []any:
+		interpolated := make([]any, len(v))
+		for i, item := range v {
+			interpolated[i] = interpolateVariables(item, variables)
+		}
+		return interpolated
+	}
+	return value
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testDashboardPath = "../integration_tests/grafana/dashboards/test.json"
+
+func TestBuildRequests(t *testing.T) {
+	dashboards, err := loadDashboards([]string{testDashboardPath})
+	if !assert.NoError(t, err) || !assert.Len(t, dashboards, 1) {
+		return
+	}
+	now := time.Unix(1708000000, 0)
+	ranges, err := parseTimeRanges(dashboards[0].Time.From+":"+dashboards[0].Time.To, now)
+	if !assert.NoError(t, err) {
+		return
+	}
+	requests, warnings := buildRequests(dashboards[0], ranges, buildOptions{
+		DashboardWidth: 1920,
+		DatasourceID: func(uid string) (int64, bool) {
+			return 1, true
+		},
+	})
+	assert.Empty(t, warnings)
+	if !assert.Len(t, requests, 2) {
+		return
+	}
+
+	prometheusRequest := requests[0]
+	assert.Equal(t, "prometheus", prometheusRequest.DatasourceType)
+	assert.Equal(t, "1707978400000", prometheusRequest.Body.From)
+	assert.Equal(t, "1708000000000", prometheusRequest.Body.To)
+	if assert.Len(t, prometheusRequest.Body.Queries, 1) {
+		query := prometheusRequest.Body.Queries[0]
+		assert.Equal(t, "A", query["refId"])
+		assert.Equal(t, int64(1920), query["maxDataPoints"])
+		// 6h / 1920 = 11.25s rounded to 10s, below the 15s prometheus min interval
+		assert.Equal(t, int64(15000), query["intervalMs"])
+		assert.Equal(t, "2A", query["requestId"])
+		assert.Equal(t, int64(1), query["datasourceId"])
+	}
+
+	postgresRequest := requests[1]
+	assert.Equal(t, "grafana-postgresql-datasource", postgresRequest.DatasourceType)
+	if assert.Len(t, postgresRequest.Body.Queries, 1) {
+		query := postgresRequest.Body.Queries[0]
+		assert.Equal(t, "select * from information_schema.tables;", query["rawSql"])
+		// 6h / 1920 = 11.25s rounded to 10s
+		assert.Equal(t, int64(10000), query["intervalMs"])
+		assert.NotContains(t, query, "requestId")
+	}
+}
+
+func TestParseTimeRanges(t *testing.T) {
+	now := time.Unix(1708000000, 0)
+	tests := []struct {
+		name          string
+		value         string
+		expectedFrom  []time.Time
+		expectedError bool
+	}{
+		{
+			name:         "relative-ranges",
+			value:        "now-6h, now-7d",
+			expectedFrom: []time.Time{now.Add(-6 * time.Hour), now.AddDate(0, 0, -7)},
+		},
+		{
+			name:         "from-to-range",
+			value:        "now-2d:now-1d",
+			expectedFrom: []time.Time{now.AddDate(0, 0, -2)},
+		},
+		{
+			name:          "absolute-time",
+			value:         "2024-01-01",
+			expectedError: true,
+		},
+		{
+			name:          "from-after-to",
+			value:         "now-1d:now-2d",
+			expectedError: true,
+		},
+	}
+	for _, test := range tests {
+		ranges, err := parseTimeRanges(test.value, now)
+		if test.expectedError {
+			assert.Error(t, err, test.name)
+			continue
+		}
+		if !assert.NoError(t, err, test.name) || !assert.Len(t, ranges, len(test.expectedFrom), test.name) {
+			continue
+		}
+		for i, r := range ranges {
+			assert.Equal(t, test.expectedFrom[i], r.From, test.name)
+		}
+	}
+}
+
+func TestInterpolateVariables(t *testing.T) {
+	variables := getVariableValues([]templateVariable{
+		{Name: "job"},
+		{Name: "instance"},
+	})
+	variables["job"] = "prometheus"
+	variables["instance"] = "a,b"
+	query := map[string]any{
+		"expr":  `up{job="$job", instance=~"${instance}"}[$__rate_interval]`,
+		"other": []any{"[[job]]", 1},
+	}
+	interpolated := interpolateVariables(query, variables).(map[string]any)
+	assert.Equal(t, `up{job="prometheus", instance=~"a,b"}[$__rate_interval]`, interpolated["expr"])
+	assert.Equal(t, []any{"prometheus", 1}, interpolated["other"])
+}
@@ -0,0 +1,237 @@
+// warmup replays the panel queries of grafana dashboards through the grafana query cache,
+// so the first viewer of the dashboard gets the cached response after a deploy.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type config struct {
+	proxyUrl       url.URL
+	dashboardPaths []string
+	timeRanges     string
+	token          string
+	user           string
+	password       string
+	repeat         int
+	concurrency    int
+	dashboardWidth int
+	minInterval    time.Duration
+	utcOffsetSec   int
+	timeout        time.Duration
+}
+
+func getConfig() (c config, err error) {
+	proxyUrl := flag.String("proxy-url", "http://localhost:8080", "grafana query cache url")
+	dashboards := flag.String("dashboards", "", "comma separated list of dashboard json files or directories")
+	flag.StringVar(&c.timeRanges, "time-ranges", "", "comma separated list of time ranges e.g. \"now-6h,now-7d\" or \"now-2d:now-1d\", defaults to the dashboard time range")
+	flag.StringVar(&c.token, "token", os.Getenv("GRAFANA_WARMUP_TOKEN"), "grafana service account token, defaults to GRAFANA_WARMUP_TOKEN")
+	flag.StringVar(&c.user, "user", os.Getenv("GRAFANA_WARMUP_USER"), "grafana user for basic auth, defaults to GRAFANA_WARMUP_USER")
+	flag.StringVar(&c.password, "password", os.Getenv("GRAFANA_WARMUP_PASSWORD"), "grafana password for basic auth, defaults to GRAFANA_WARMUP_PASSWORD")
+	flag.IntVar(&c.repeat, "repeat", 2, "number of times each request is sent, should be at least MIN_REQUEST_COUNT")
+	flag.IntVar(&c.concurrency, "concurrency", 4, "number of requests sent in parallel")
+	flag.IntVar(&c.dashboardWidth, "dashboard-width", 1920, "dashboard width in pixels, used to calculate the panel max data points")
+	flag.DurationVar(&c.minInterval, "min-interval", 0, "min query interval, defaults to 15s for prometheus")
+	flag.IntVar(&c.utcOffsetSec, "utc-offset-seconds", 0, "browser utc offset sent in the prometheus queries")
+	flag.DurationVar(&c.timeout, "timeout", 60*time.Second, "request timeout")
+	flag.Parse()
+
+	parsedUrl, err := url.Parse(*proxyUrl)
+	if err != nil {
+		return c, fmt.Errorf("[getConfig] invalid proxy-url: %w", err)
+	}
+	c.proxyUrl = *parsedUrl
+	for _, path := range strings.Split(*dashboards, ",") {
+		if path = strings.TrimSpace(path); len(path) != 0 {
+			c.dashboardPaths = append(c.dashboardPaths, path)
+		}
+	}
+	if len(c.dashboardPaths) == 0 {
+		return c, fmt.Errorf("[getConfig] dashboards not set")
+	}
+	if len(c.token) == 0 && len(c.user) == 0 {
+		return c, fmt.Errorf("[getConfig] either token or user/password required")
+	}
+	if c.repeat < 1 || c.concurrency < 1 {
+		return c, fmt.Errorf("[getConfig] repeat and concurrency should be greater than 0")
+	}
+	return
+}
+
+type warmupClient struct {
+	config        config
+	httpClient    *http.Client
+	datasourceIDs sync.Map
+}
+
+func (w *warmupClient) newRequest(method string, path string, body io.Reader) (*http.Request, error) {
+	requestUrl, err := url.JoinPath(w.config.proxyUrl.String(), path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to join url path: %w", err)
+	}
+	req, err := http.NewRequest(method, requestUrl, body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create request: %w", err)
+	}
+	if len(w.config.token) != 0 {
+		req.Header.Set("Authorization", "Bearer "+w.config.token)
+	} else {
+		req.SetBasicAuth(w.config.user, w.config.password)
+	}
+	return req, nil
+}
+
+// datasourceID returns the numeric id of the datasource, grafana frontend sends it with every query
+func (w *warmupClient) datasourceID(uid string) (int64, bool) {
+	if id, ok := w.datasourceIDs.Load(uid); ok {
+		return id.(int64), id.(int64) != 0
+	}
+	var id int64 = 0
+	defer func() { w.datasourceIDs.Store(uid, id) }()
+
+	req, err := w.newRequest("GET", "/api/datasources/uid/"+url.PathEscape(uid), nil)
+	if err != nil {
+		return 0, false
+	}
+	response, err := w.httpClient.Do(req)
+	if err != nil {
+		log.Printf("unable to get datasource %s: %v", uid, err)
+		return 0, false
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		log.Printf("unable to get datasource %s: %d status code", uid, response.StatusCode)
+		return 0, false
+	}
+	var datasource struct {
+		ID int64 `json:"id"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&datasource); err != nil {
+		log.Printf("unable to decode datasource %s: %v", uid, err)
+		return 0, false
+	}
+	id = datasource.ID
+	return id, id != 0
+}
+
+// send sends the query request and returns the X-Cache-Status response header
+func (w *warmupClient) send(request warmupRequest) (cacheStatus string, err error) {
+	body, err := json.Marshal(request.Body)
+	if err != nil {
+		return "", fmt.Errorf("unable to marshal request body: %w", err)
+	}
+	req, err := w.newRequest("POST", "/api/ds/query", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	queryParams := make(url.Values)
+	queryParams.Add("ds_type", request.DatasourceType)
+	req.URL.RawQuery = queryParams.Encode()
+	req.Header.Set("Content-Type", "application/json")
+
+	response, err := w.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("query request failed: %w", err)
+	}
+	defer response.Body.Close()
+	// the response is cached only if it is read completely
+	if _, err := io.Copy(io.Discard, response.Body); err != nil {
+		return "", fmt.Errorf("unable to read response: %w", err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%d status code", response.StatusCode)
+	}
+	return response.Header.Get("X-Cache-Status"), nil
+}
+
+func (w *warmupClient) run(requests []warmupRequest) (failed int) {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	queue := make(chan warmupRequest)
+	for i := 0; i < w.config.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for request := range queue {
+				// requests are repeated one after another so the proxy_cache_min_uses count is reached
+				for attempt := 1; attempt <= w.config.repeat; attempt++ {
+					cacheStatus, err := w.send(request)
+					if err != nil {
+						log.Printf("dashboard %s panel %d (%s): %v", request.DashboardUID, request.PanelID, request.PanelTitle, err)
+						mutex.Lock()
+						failed++
+						mutex.Unlock()
+						break
+					}
+					log.Printf("dashboard %s panel %d (%s) from %s to %s: attempt %d, cache status %s",
+						request.DashboardUID, request.PanelID, request.PanelTitle,
+						request.Body.From, request.Body.To, attempt, cacheStatus)
+				}
+			}
+		}()
+	}
+	for _, request := range requests {
+		queue <- request
+	}
+	close(queue)
+	wg.Wait()
+	return
+}
+
+func main() {
+	c, err := getConfig()
+	if err != nil {
+		flag.Usage()
+		log.Fatal(err)
+	}
+	dashboards, err := loadDashboards(c.dashboardPaths)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	client := &warmupClient{
+		config:     c,
+		httpClient: &http.Client{Timeout: c.timeout},
+	}
+	options := buildOptions{
+		DashboardWidth: c.dashboardWidth,
+		MinInterval:    c.minInterval,
+		UtcOffsetSec:   c.utcOffsetSec,
+		DatasourceID:   client.datasourceID,
+	}
+
+	now := time.Now()
+	var requests []warmupRequest
+	for _, d := range dashboards {
+		timeRanges := c.timeRanges
+		if len(timeRanges) == 0 {
+			timeRanges = d.Time.From + ":" + d.Time.To
+		}
+		ranges, err := parseTimeRanges(timeRanges, now)
+		if err != nil {
+			log.Printf("dashboard %s ignored: %v", d.UID, err)
+			continue
+		}
+		dashboardRequests, warnings := buildRequests(d, ranges, options)
+		for _, warning := range warnings {
+			log.Print(warning)
+		}
+		requests = append(requests, dashboardRequests...)
+	}
+	log.Printf("sending %d query requests", len(requests))
+
+	if failed := client.run(requests); failed != 0 {
+		log.Fatalf("%d query requests failed", failed)
+	}
+}
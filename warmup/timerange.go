@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type timeRange struct {
+	From time.Time
+	To   time.Time
+}
+
+var relativeTimePattern = regexp.MustCompile(`^now(-(\d+)([smhdwMy]))?$`)
+
+// parseRelativeTime parses grafana relative time e.g. now, now-6h, now-7d
+func parseRelativeTime(value string, now time.Time) (t time.Time, err error) {
+	match := relativeTimePattern.FindStringSubmatch(strings.TrimSpace(value))
+	if match == nil {
+		return t, fmt.Errorf("[parseRelativeTime] unsupported time \"%s\", only now and now-<number><unit> are supported", value)
+	}
+	if len(match[1]) == 0 {
+		return now, nil
+	}
+	amount, err := strconv.Atoi(match[2])
+	if err != nil {
+		return t, fmt.Errorf("[parseRelativeTime] invalid number in \"%s\": %w", value, err)
+	}
+	switch match[3] {
+	case "s":
+		return now.Add(-time.Duration(amount) * time.Second), nil
+	case "m":
+		return now.Add(-time.Duration(amount) * time.Minute), nil
+	case "h":
+		return now.Add(-time.Duration(amount) * time.Hour), nil
+	case "d":
+		return now.AddDate(0, 0, -amount), nil
+	case "w":
+		return now.AddDate(0, 0, -7*amount), nil
+	case "M":
+		return now.AddDate(0, -amount, 0), nil
+	case "y":
+		return now.AddDate(-amount, 0, 0), nil
+	}
+	return t, fmt.Errorf("[parseRelativeTime] unsupported unit in \"%s\"", value)
+}
+
+// parseTimeRanges parses comma separated list of relative time ranges e.g. "now-6h,now-24h" (to = now)
+// or "now-2d:now-1d" (from:to)
+func parseTimeRanges(value string, now time.Time) (ranges []timeRange, err error) {
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		from, to, found := strings.Cut(item, ":")
+		if !found {
+			to = "now"
+		}
+		r, err := newTimeRange(from, to, now)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, r)
+	}
+	return
+}
+
+func newTimeRange(from string, to string, now time.Time) (r timeRange, err error) {
+	r.From, err = parseRelativeTime(from, now)
+	if err != nil {
+		return
+	}
+	r.To, err = parseRelativeTime(to, now)
+	if err != nil {
+		return
+	}
+	if !r.From.Before(r.To) {
+		return r, fmt.Errorf("[newTimeRange] from (%s) should be before to (%s)", from, to)
+	}
+	return
+}
+
+// roundInterval is same as grafana frontend interval rounding (rangeutil.roundInterval),
+// queries need the same intervalMs as the browser to get the same cache key
+func roundInterval(intervalMs int64) int64 {
+	steps := []struct {
+		below   int64
+		rounded int64
+	}{
+		{10, 1},
+		{15, 10},
+		{35, 20},
+		{75, 50},
+		{150, 100},
+		{350, 200},
+		{750, 500},
+		{1500, 1000},
+		{3500, 2000},
+		{7500, 5000},
+		{12500, 10000},
+		{17500, 15000},
+		{25000, 20000},
+		{45000, 30000},
+		{90000, 60000},
+		{210000, 120000},
+		{450000, 300000},
+		{750000, 600000},
+		{1050000, 900000},
+		{1500000, 1200000},
+		{2700000, 1800000},
+		{5400000, 3600000},
+		{9000000, 7200000},
+		{16200000, 10800000},
+		{32400000, 21600000},
+		{86400000, 43200000},
+		{604800000, 86400000},
+		{1814400000, 604800000},
+		{3628800000, 2592000000},
+	}
+	for _, step := range steps {
+		if intervalMs < step.below {
+			return step.rounded
+		}
+	}
+	return 31536000000
+}
+
+// calculateIntervalMs returns the query interval for the time range and max data points,
+// minInterval is the panel (or datasource) min interval
+func calculateIntervalMs(r timeRange, maxDataPoints int64, minInterval time.Duration) int64 {
+	if maxDataPoints <= 0 {
+		maxDataPoints = 1
+	}
+	intervalMs := roundInterval(r.To.Sub(r.From).Milliseconds() / maxDataPoints)
+	if minInterval.Milliseconds() > intervalMs {
+		intervalMs = minInterval.Milliseconds()
+	}
+	return intervalMs
+}